@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+const (
+	ScopePassesCreate = "passes:create" // Create passes
+	ScopePassesUpdate = "passes:update" // Update the cashback of passes
+	ScopePassesRead   = "passes:read"   // Get the links of passes
+	ScopeAdmin        = "admin"         // Manage API keys and push jobs. Grants every other scope
+
+	apiKeyPrefix       = "b2w_" // apiKeyPrefix starts every API key so leaked keys are easy to recognise
+	apiKeyPrefixLength = 12     // apiKeyPrefixLength is the number of leading characters of the key stored in clear
+)
+
+// Scopes is the list of all the scopes an API key can be granted
+var Scopes = []string{ScopePassesCreate, ScopePassesUpdate, ScopePassesRead, ScopeAdmin}
+
+// ErrInvalidAPIKey is returned when the key is unknown or revoked
+var ErrInvalidAPIKey = errors.New("invalid API key")
+
+// HasScope reports whether the API key grants the scope
+func (key APIKey) HasScope(scope string) bool {
+	for _, granted := range strings.Fields(key.Scopes) {
+		if granted == scope || granted == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// hashAPIKey returns the SHA-256 hash of the key as a hex string.
+// The keys are random, so a fast hash without salt is enough to make the stored hashes useless for authentication
+func hashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// ValidateScopes returns the deduplicated scopes, or an error naming the first unknown one
+func ValidateScopes(scopes []string) ([]string, error) {
+	valid := []string{}
+	seen := make(map[string]bool)
+	for _, scope := range scopes {
+		known := false
+		for _, s := range Scopes {
+			if s == scope {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown scope %q", scope)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			valid = append(valid, scope)
+		}
+	}
+
+	if len(valid) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+	return valid, nil
+}
+
+// IssueAPIKey creates a new API key for the owner with the given scopes.
+// It returns the stored key and the key itself, which can't be retrieved later
+func IssueAPIKey(db *gorm.DB, owner string, scopes []string) (APIKey, string, error) {
+	secret, err := GenerateToken()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+
+	return createAPIKey(db, owner, scopes, apiKeyPrefix+secret)
+}
+
+func createAPIKey(db *gorm.DB, owner string, scopes []string, key string) (APIKey, string, error) {
+	apiKey := APIKey{
+		ID:     uuid.New(),
+		Owner:  owner,
+		Prefix: key[:min(apiKeyPrefixLength, len(key))],
+		Hash:   hashAPIKey(key),
+		Scopes: strings.Join(scopes, " "),
+	}
+	if err := db.Create(&apiKey).Error; err != nil {
+		return APIKey{}, "", err
+	}
+
+	return apiKey, key, nil
+}
+
+// RotateAPIKey revokes the API key and issues a new one for the same owner and scopes
+func RotateAPIKey(db *gorm.DB, id uuid.UUID) (APIKey, string, error) {
+	var (
+		apiKey APIKey
+		key    string
+	)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		old, err := RevokeAPIKey(tx, id)
+		if err != nil {
+			return err
+		}
+
+		apiKey, key, err = IssueAPIKey(tx, old.Owner, strings.Fields(old.Scopes))
+		return err
+	})
+
+	return apiKey, key, err
+}
+
+// RevokeAPIKey revokes the API key. Revoking a revoked key returns ErrInvalidAPIKey
+func RevokeAPIKey(db *gorm.DB, id uuid.UUID) (APIKey, error) {
+	var apiKey APIKey
+	if err := db.Where("id = ? AND revoked_at IS NULL", id).First(&apiKey).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return APIKey{}, ErrInvalidAPIKey
+		}
+		return APIKey{}, err
+	}
+
+	now := time.Now()
+	if err := db.Model(&apiKey).Update("revoked_at", now).Error; err != nil {
+		return APIKey{}, err
+	}
+
+	return apiKey, nil
+}
+
+// GetAPIKeys returns all the API keys, including the revoked ones, newest first
+func GetAPIKeys(db *gorm.DB) ([]APIKey, error) {
+	var apiKeys []APIKey
+	if err := db.Order("created_at DESC").Find(&apiKeys).Error; err != nil {
+		return nil, err
+	}
+
+	return apiKeys, nil
+}
+
+// AuthenticateAPIKey returns the active API key matching the given key and records its use
+func AuthenticateAPIKey(db *gorm.DB, key string) (APIKey, error) {
+	var apiKey APIKey
+	rec := db.Where("hash = ? AND revoked_at IS NULL", hashAPIKey(key)).Limit(1).Find(&apiKey)
+	if rec.Error != nil {
+		return APIKey{}, rec.Error
+	}
+	if rec.RowsAffected == 0 {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+
+	if err := db.Model(&apiKey).UpdateColumn("last_used_at", time.Now()).Error; err != nil {
+		log.Error().Err(err).Str("Prefix", apiKey.Prefix).Msg("Failed to record API key use")
+	}
+
+	return apiKey, nil
+}
+
+// BootstrapAPIKey stores the key from BOOTSTRAP_API_KEY as an admin key, so the first keys can be issued through the API.
+// The key is stored once. After it is revoked it is never restored
+func BootstrapAPIKey(db *gorm.DB, key string) error {
+	if key == "" {
+		return nil
+	}
+
+	var count int64
+	if err := db.Model(&APIKey{}).Where("hash = ?", hashAPIKey(key)).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	apiKey, _, err := createAPIKey(db, "bootstrap", []string{ScopeAdmin}, key)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Str("Prefix", apiKey.Prefix).Msg("Bootstrap API key stored")
+	return nil
+}
+
+// AuthRequired authorises the requests of our backend services with an API key granting the scope.
+// The key is sent in the Authorization header, optionally with the Bearer scheme
+func AuthRequired(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+
+		apiKey, err := AuthenticateAPIKey(db, key)
+		if err != nil && !errors.Is(err, ErrInvalidAPIKey) {
+			log.Error().Err(err).Msg("Failed to authenticate API key")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": "Unauthorized",
+			})
+			c.Abort()
+			return
+		}
+
+		if !apiKey.HasScope(scope) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "Forbidden",
+				"scope": scope,
+			})
+			c.Abort()
+			return
+		}
+
+		c.Set("apiKey", apiKey)
+		c.Next()
+	}
+}
+
+func issueAPIKeyRequest(c *gin.Context) {
+	owner := c.PostForm("owner")
+	scopes := []string{}
+	for _, value := range c.PostFormArray("scopes") {
+		scopes = append(scopes, strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' })...)
+	}
+
+	if owner == "" {
+		c.JSON(400, gin.H{
+			"message": "Missing required fields",
+			"fields":  []string{"owner"},
+		})
+		return
+	}
+
+	scopes, err := ValidateScopes(scopes)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"message": "Invalid scopes",
+			"error":   err.Error(),
+			"scopes":  Scopes,
+		})
+		return
+	}
+
+	apiKey, key, err := IssueAPIKey(db, owner, scopes)
+	if err != nil {
+		c.JSON(500, gin.H{
+			"message": "Failed to issue API key",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	log.Info().
+		Str("Owner", apiKey.Owner).
+		Str("Prefix", apiKey.Prefix).
+		Str("Scopes", apiKey.Scopes).
+		Msg("API key issued")
+
+	c.JSON(201, gin.H{
+		"message": "API key was issued successfully. Store it now, it can't be retrieved later",
+		"key":     key,
+		"apiKey":  apiKey,
+	})
+}
+
+func listAPIKeysRequest(c *gin.Context) {
+	apiKeys, err := GetAPIKeys(db)
+	if err != nil {
+		c.JSON(500, gin.H{
+			"message": "Failed to get API keys",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"message": "API keys were retrieved successfully",
+		"apiKeys": apiKeys,
+	})
+}
+
+func rotateAPIKeyRequest(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{
+			"message": "Invalid API key ID",
+		})
+		return
+	}
+
+	apiKey, key, err := RotateAPIKey(db, id)
+	if errors.Is(err, ErrInvalidAPIKey) {
+		c.JSON(404, gin.H{
+			"message": "API key not found or already revoked",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{
+			"message": "Failed to rotate API key",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	log.Info().
+		Str("RotatedID", id.String()).
+		Str("Prefix", apiKey.Prefix).
+		Msg("API key rotated")
+
+	c.JSON(200, gin.H{
+		"message": "API key was rotated successfully. Store it now, it can't be retrieved later",
+		"key":     key,
+		"apiKey":  apiKey,
+	})
+}
+
+func revokeAPIKeyRequest(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{
+			"message": "Invalid API key ID",
+		})
+		return
+	}
+
+	apiKey, err := RevokeAPIKey(db, id)
+	if errors.Is(err, ErrInvalidAPIKey) {
+		c.JSON(404, gin.H{
+			"message": "API key not found or already revoked",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{
+			"message": "Failed to revoke API key",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	log.Info().
+		Str("Prefix", apiKey.Prefix).
+		Msg("API key revoked")
+
+	c.JSON(200, gin.H{
+		"message": "API key was revoked successfully",
+		"apiKey":  apiKey,
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAPIKeyHasScope(t *testing.T) {
+	tests := []struct {
+		scopes string
+		scope  string
+		want   bool
+	}{
+		{"passes:read", ScopePassesRead, true},
+		{"passes:create passes:update", ScopePassesUpdate, true},
+		{"passes:create passes:update", ScopePassesRead, false},
+		{"admin", ScopePassesCreate, true},
+		{"admin", ScopeAdmin, true},
+		{"passes:read passes:update", ScopeAdmin, false},
+		{"passes:readonly", ScopePassesRead, false},
+		{"", ScopePassesRead, false},
+	}
+	for _, test := range tests {
+		key := APIKey{Scopes: test.scopes}
+		if got := key.HasScope(test.scope); got != test.want {
+			t.Errorf("APIKey{Scopes: %q}.HasScope(%q) = %v, want %v", test.scopes, test.scope, got, test.want)
+		}
+	}
+}
+
+func TestValidateScopes(t *testing.T) {
+	tests := []struct {
+		scopes []string
+		want   []string
+		valid  bool
+	}{
+		{[]string{"passes:read"}, []string{"passes:read"}, true},
+		{[]string{"passes:create", "passes:update", "passes:create"}, []string{"passes:create", "passes:update"}, true},
+		{[]string{"admin"}, []string{"admin"}, true},
+		{[]string{"passes:read", "passes:delete"}, nil, false},
+		{[]string{"Passes:Read"}, nil, false},
+		{[]string{}, nil, false},
+		{nil, nil, false},
+	}
+	for _, test := range tests {
+		got, err := ValidateScopes(test.scopes)
+		if (err == nil) != test.valid {
+			t.Errorf("ValidateScopes(%q) error = %v, want valid %v", test.scopes, err, test.valid)
+			continue
+		}
+		if test.valid && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ValidateScopes(%q) = %q, want %q", test.scopes, got, test.want)
+		}
+	}
+}
+
+func TestHashAPIKey(t *testing.T) {
+	if hash := hashAPIKey("b2w_key"); hash != "bd8ccbb187a5a16a05fe4548aef33a65186ce05e67f7c74797556921f9ca85b3" {
+		t.Errorf("hashAPIKey = %s", hash)
+	}
+	if hashAPIKey("b2w_key") == hashAPIKey("b2w_kez") {
+		t.Error("different keys have the same hash")
+	}
+}
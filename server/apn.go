@@ -1,39 +1,174 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
 	"github.com/rs/zerolog/log"
 	"github.com/sideshow/apns2"
 	"github.com/sideshow/apns2/certificate"
+	"github.com/sideshow/apns2/token"
+)
+
+const (
+	APNSAuthCertificate = "certificate" // Authenticate with the Pass Type ID certificate (.p12)
+	APNSAuthToken       = "token"       // Authenticate with a JWT signed by the APNs auth key (.p8)
+
+	APNSProduction  = "production"  // Push to devices through the production APNs servers
+	APNSDevelopment = "development" // Push to devices through the sandbox APNs servers
 )
 
-func SendNotificationPushAboutUpdate() {
+// NewPushClient creates the APNs client configured by the environment variables:
+// APNS_AUTH selects certificate (APNS_CERT_FILE, APNS_CERT_PASSWORD) or token (APNS_KEY_FILE, APNS_KEY_ID, APNS_TEAM_ID) authentication
+// and APNS_ENV selects the production or development environment
+func NewPushClient() (*apns2.Client, error) {
+	var client *apns2.Client
+
+	switch auth := getEnv("APNS_AUTH", APNSAuthCertificate); auth {
+	case APNSAuthCertificate:
+		cert, err := certificate.FromP12File(getEnv("APNS_CERT_FILE", CertificatesDir+"Certificates.p12"), os.Getenv("APNS_CERT_PASSWORD"))
+		if err != nil {
+			return nil, fmt.Errorf("error loading push certificate: %v", err)
+		}
+		client = apns2.NewClient(cert)
+	case APNSAuthToken:
+		authKey, err := token.AuthKeyFromFile(os.Getenv("APNS_KEY_FILE"))
+		if err != nil {
+			return nil, fmt.Errorf("error loading push auth key: %v", err)
+		}
+		if os.Getenv("APNS_KEY_ID") == "" || os.Getenv("APNS_TEAM_ID") == "" {
+			return nil, errors.New("APNS_KEY_ID and APNS_TEAM_ID are required for token authentication")
+		}
+		client = apns2.NewTokenClient(&token.Token{
+			AuthKey: authKey,
+			KeyID:   os.Getenv("APNS_KEY_ID"),
+			TeamID:  os.Getenv("APNS_TEAM_ID"),
+		})
+	default:
+		return nil, fmt.Errorf("unknown APNS_AUTH %q", auth)
+	}
+
+	// Development is used for devices running builds installed from Xcode (sandbox push tokens)
+	switch env := getEnv("APNS_ENV", APNSProduction); env {
+	case APNSProduction:
+		return client.Production(), nil
+	case APNSDevelopment:
+		return client.Development(), nil
+	default:
+		return nil, fmt.Errorf("unknown APNS_ENV %q", env)
+	}
+}
+
+// PushResult is the result of the update push sent to one device
+type PushResult struct {
+	DeviceLibraryIdentifier string `json:"deviceLibraryIdentifier"`
+	PushToken               string `json:"pushToken"`
+	Sent                    bool   `json:"sent"`
+	StatusCode              int    `json:"statusCode,omitempty"`
+	Reason                  string `json:"reason,omitempty"`
+	Error                   string `json:"error,omitempty"`
+}
 
-	cert, err := certificate.FromP12File("./certificates/Certificates.p12", "")
+// SendNotificationPushAboutUpdate notifies every device registered for the pass with the given serial number
+// that the pass was updated. Wallet expects an empty payload and fetches the updated pass by itself
+func SendNotificationPushAboutUpdate(serialNumber string) ([]PushResult, error) {
+	targets, err := GetPushTargets(db, serialNumber)
 	if err != nil {
-		log.Error().
-			Err(err).
-			Msg("Push Certificate Error")
+		return nil, fmt.Errorf("error getting devices of the pass: %v", err)
+	}
+	if len(targets) == 0 {
+		return []PushResult{}, nil
+	}
+
+	if pushClient == nil {
+		return nil, errors.New("push client is not configured")
 	}
 
-	notification := &apns2.Notification{}
-	notification.DeviceToken = "b820c3afeda0a58ae605bfb0b9a29c5c97c74b4d21d6fa32b0ead17c1e917fc2"
-	notification.Topic = "pass.com.finom.bank2wallet"
-	notification.Payload = []byte(`{"aps":{"alert":"Your cashback balance was updated!"}}`)
+	results := make([]PushResult, 0, len(targets))
+	for _, target := range targets {
+		notification := &apns2.Notification{
+			DeviceToken: target.PushToken,
+			Topic:       target.PassTypeIdentifier,
+			Payload:     []byte(`{}`),
+		}
 
-	// If you want to test push notifications for builds running directly from XCode (Development), use
-	// client := apns2.NewClient(cert).Development()
-	// For apps published to the app store or installed as an ad-hoc distribution use Production()
+		result := PushResult{
+			DeviceLibraryIdentifier: target.DeviceLibraryIdentifier,
+			PushToken:               target.PushToken,
+		}
 
-	client := apns2.NewClient(cert).Production()
-	res, err := client.Push(notification)
+		res, err := pushClient.Push(notification)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("SerialNumber", serialNumber).
+				Str("DeviceLibraryIdentifier", target.DeviceLibraryIdentifier).
+				Msg("Error sending push notification")
+			result.Error = err.Error()
+		} else {
+			result.Sent = res.Sent()
+			result.StatusCode = res.StatusCode
+			result.Reason = res.Reason
+			handleDeadPushToken(target.PushToken, res)
+		}
+
+		log.Debug().
+			Interface("Result", result).
+			Str("SerialNumber", serialNumber).
+			Msg("Notification result")
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// CountSentPushes returns the number of devices that received the push
+func CountSentPushes(results []PushResult) int {
+	sent := 0
+	for _, result := range results {
+		if result.Sent {
+			sent++
+		}
+	}
+	return sent
+}
+
+// isDeadTokenReason reports whether the APNs reason code means the push token will never be valid again
+func isDeadTokenReason(reason string) bool {
+	switch reason {
+	case apns2.ReasonUnregistered, apns2.ReasonBadDeviceToken, apns2.ReasonDeviceTokenNotForTopic:
+		return true
+	}
+	return false
+}
+
+// handleDeadPushToken invalidates the registrations of the push token if APNs reported it as dead
+func handleDeadPushToken(pushToken string, res *apns2.Response) {
+	if res.Sent() || !isDeadTokenReason(res.Reason) {
+		return
+	}
+
+	// APNs reports the time the token stopped being valid only for Unregistered
+	invalidatedAt := res.Timestamp.Time
+	if invalidatedAt.IsZero() {
+		invalidatedAt = time.Now()
+	}
 
+	count, err := InvalidatePushToken(db, pushToken, res.Reason, invalidatedAt)
 	if err != nil {
 		log.Error().
 			Err(err).
-			Msg("Error sending push notification")
+			Str("Reason", res.Reason).
+			Msg("Error invalidating push token")
+		return
 	}
 
-	log.Debug().
-		Interface("Result", res).
-		Msg("Notification result")
+	log.Info().
+		Str("Reason", res.Reason).
+		Time("InvalidatedAt", invalidatedAt).
+		Int64("Registrations", count).
+		Msg("Push token invalidated")
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// FieldError describes why the value of a request field is invalid
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// ibanLengths is the length of the IBANs of every country in the IBAN registry
+var ibanLengths = map[string]int{
+	"AD": 24, "AE": 23, "AL": 28, "AT": 20, "AZ": 28, "BA": 20, "BE": 16, "BG": 22, "BH": 22, "BI": 27,
+	"BR": 29, "BY": 28, "CH": 21, "CR": 22, "CY": 28, "CZ": 24, "DE": 22, "DJ": 27, "DK": 18, "DO": 28,
+	"EE": 20, "EG": 29, "ES": 24, "FI": 18, "FK": 18, "FO": 18, "FR": 27, "GB": 22, "GE": 22, "GI": 23,
+	"GL": 18, "GR": 27, "GT": 28, "HR": 21, "HU": 28, "IE": 22, "IL": 23, "IQ": 23, "IS": 26, "IT": 27,
+	"JO": 30, "KW": 30, "KZ": 20, "LB": 28, "LC": 32, "LI": 21, "LT": 20, "LU": 20, "LV": 21, "LY": 25,
+	"MC": 27, "MD": 24, "ME": 22, "MK": 19, "MN": 20, "MR": 27, "MT": 31, "MU": 30, "NI": 28, "NL": 18,
+	"NO": 15, "OM": 23, "PK": 24, "PL": 28, "PS": 29, "PT": 25, "QA": 29, "RO": 24, "RS": 22, "RU": 33,
+	"SA": 24, "SC": 31, "SD": 18, "SE": 24, "SI": 19, "SK": 24, "SM": 27, "SO": 23, "ST": 25, "SV": 28,
+	"TL": 23, "TN": 24, "TR": 26, "UA": 29, "VA": 22, "VG": 24, "XK": 20, "YE": 30,
+}
+
+// bicCountryAliases are the countries whose banks use IBANs of another country, keyed by the IBAN country
+var bicCountryAliases = map[string][]string{
+	"FR": {"BL", "GF", "GP", "MC", "MF", "MQ", "NC", "PF", "PM", "RE", "TF", "WF", "YT"},
+	"GB": {"GG", "IM", "JE"},
+	"FI": {"AX"},
+}
+
+var (
+	bicPattern      = regexp.MustCompile(`^[A-Z]{4}[A-Z]{2}[A-Z0-9]{2}([A-Z0-9]{3})?$`)
+	ibanBBANPattern = regexp.MustCompile(`^[A-Z0-9]+$`)
+)
+
+// NormalizeIBAN removes the spaces of the IBAN and converts it to upper case
+func NormalizeIBAN(iban string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(iban), ""))
+}
+
+// NormalizeBIC removes the spaces of the BIC and converts it to upper case
+func NormalizeBIC(bic string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(bic), ""))
+}
+
+// ValidateIBAN checks the length of the normalized IBAN for its country and its check digits
+func ValidateIBAN(iban string) error {
+	if len(iban) < 4 || !ibanBBANPattern.MatchString(iban) {
+		return errors.New("IBAN must contain only letters and digits and start with a country code and 2 check digits")
+	}
+
+	length, ok := ibanLengths[iban[:2]]
+	if !ok {
+		return fmt.Errorf("IBAN country %s is not supported", iban[:2])
+	}
+	if len(iban) != length {
+		return fmt.Errorf("IBAN of %s must have %d characters, got %d", iban[:2], length, len(iban))
+	}
+
+	if mod97(iban[4:]+iban[:4]) != 1 {
+		return errors.New("IBAN check digits are invalid")
+	}
+	return nil
+}
+
+// ValidateBIC checks the format of the normalized BIC
+func ValidateBIC(bic string) error {
+	if !bicPattern.MatchString(bic) {
+		return errors.New("BIC must have 8 or 11 characters: a 4 letter bank code, a 2 letter country code, a 2 character location code and an optional 3 character branch code")
+	}
+	return nil
+}
+
+// BICMatchesIBANCountry reports whether the bank of the BIC is in the country of the IBAN
+func BICMatchesIBANCountry(bic, iban string) bool {
+	bicCountry, ibanCountry := bic[4:6], iban[:2]
+	if bicCountry == ibanCountry {
+		return true
+	}
+	for _, alias := range bicCountryAliases[ibanCountry] {
+		if bicCountry == alias {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateBankDetails validates the normalized IBAN and BIC and returns the errors of each field.
+// The BIC is optional, an empty BIC is not validated
+func ValidateBankDetails(iban, bic string) []FieldError {
+	fieldErrors := []FieldError{}
+
+	ibanErr := ValidateIBAN(iban)
+	if ibanErr != nil {
+		fieldErrors = append(fieldErrors, FieldError{Field: "iban", Reason: ibanErr.Error()})
+	}
+	if bic == "" {
+		return fieldErrors
+	}
+	bicErr := ValidateBIC(bic)
+	if bicErr != nil {
+		fieldErrors = append(fieldErrors, FieldError{Field: "bic", Reason: bicErr.Error()})
+	}
+
+	if ibanErr == nil && bicErr == nil && !BICMatchesIBANCountry(bic, iban) {
+		fieldErrors = append(fieldErrors, FieldError{
+			Field:  "bic",
+			Reason: fmt.Sprintf("BIC country %s doesn't match the IBAN country %s", bic[4:6], iban[:2]),
+		})
+	}
+
+	return fieldErrors
+}
+
+// mod97 returns the ISO 7064 MOD 97-10 remainder of the alphanumeric string, with the letters replaced by numbers (A = 10 ... Z = 35)
+func mod97(s string) int {
+	remainder := 0
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			remainder = (remainder*10 + int(r-'0')) % 97
+		case r >= 'A' && r <= 'Z':
+			remainder = (remainder*100 + int(r-'A') + 10) % 97
+		}
+	}
+	return remainder
+}
@@ -0,0 +1,128 @@
+package main
+
+import "testing"
+
+func TestValidateIBAN(t *testing.T) {
+	tests := []struct {
+		iban  string
+		valid bool
+	}{
+		{"DE89370400440532013000", true},
+		{"GB82WEST12345698765432", true},
+		{"FR1420041010050500013M02606", true},
+		{"NL91ABNA0417164300", true},
+		{"BE68539007547034", true},
+		{"NO9386011117947", true},
+		{"DE89370400440532013001", false},  // wrong check digits
+		{"DE8937040044053201300", false},   // too short for Germany
+		{"DE893704004405320130000", false}, // too long for Germany
+		{"XX89370400440532013000", false},  // unknown country
+		{"DE89 3704 0044 0532 0130 00", false},
+		{"DE89-370400440532013000", false},
+		{"DE8", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		err := ValidateIBAN(test.iban)
+		if (err == nil) != test.valid {
+			t.Errorf("ValidateIBAN(%q) = %v, want valid %v", test.iban, err, test.valid)
+		}
+	}
+}
+
+func TestNormalizeIBAN(t *testing.T) {
+	if iban := NormalizeIBAN(" de89 3704 0044 0532 0130 00 "); iban != "DE89370400440532013000" {
+		t.Errorf("NormalizeIBAN = %q", iban)
+	}
+	if bic := NormalizeBIC(" coba de ff xxx"); bic != "COBADEFFXXX" {
+		t.Errorf("NormalizeBIC = %q", bic)
+	}
+}
+
+func TestValidateBIC(t *testing.T) {
+	tests := []struct {
+		bic   string
+		valid bool
+	}{
+		{"COBADEFF", true},
+		{"COBADEFFXXX", true},
+		{"DEUTDEFF500", true},
+		{"COBADEF", false},      // 7 characters
+		{"COBADEFFXX", false},   // 10 characters
+		{"COB1DEFF", false},     // digit in the bank code
+		{"COBAD1FF", false},     // digit in the country code
+		{"cobadeff", false},     // not normalized
+		{"COBADEFFXXXX", false}, // 12 characters
+	}
+	for _, test := range tests {
+		err := ValidateBIC(test.bic)
+		if (err == nil) != test.valid {
+			t.Errorf("ValidateBIC(%q) = %v, want valid %v", test.bic, err, test.valid)
+		}
+	}
+}
+
+func TestBICMatchesIBANCountry(t *testing.T) {
+	tests := []struct {
+		bic, iban string
+		match     bool
+	}{
+		{"COBADEFFXXX", "DE89370400440532013000", true},
+		{"BNPAFRPP", "FR1420041010050500013M02606", true},
+		{"BNPAGPGP", "FR1420041010050500013M02606", true}, // Guadeloupe banks use French IBANs
+		{"BARCJESH", "GB82WEST12345698765432", true},      // Jersey banks use British IBANs
+		{"COBADEFFXXX", "FR1420041010050500013M02606", false},
+		{"BNPAGPGP", "DE89370400440532013000", false},
+	}
+	for _, test := range tests {
+		if match := BICMatchesIBANCountry(test.bic, test.iban); match != test.match {
+			t.Errorf("BICMatchesIBANCountry(%q, %q) = %v, want %v", test.bic, test.iban, match, test.match)
+		}
+	}
+}
+
+func TestValidateBankDetails(t *testing.T) {
+	tests := []struct {
+		name, iban, bic string
+		fields          []string
+	}{
+		{"valid", "DE89370400440532013000", "COBADEFFXXX", nil},
+		{"no BIC", "DE89370400440532013000", "", nil},
+		{"invalid IBAN without BIC", "DE89370400440532013001", "", []string{"iban"}},
+		{"invalid IBAN", "DE89370400440532013001", "COBADEFFXXX", []string{"iban"}},
+		{"invalid both", "DE8937", "COBA", []string{"iban", "bic"}},
+		{"country mismatch", "DE89370400440532013000", "BNPAFRPP", []string{"bic"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fieldErrors := ValidateBankDetails(test.iban, test.bic)
+			if len(fieldErrors) != len(test.fields) {
+				t.Fatalf("got errors %+v, want fields %v", fieldErrors, test.fields)
+			}
+			for i, fieldError := range fieldErrors {
+				if fieldError.Field != test.fields[i] || fieldError.Reason == "" {
+					t.Errorf("error %d = %+v, want field %s with a reason", i, fieldError, test.fields[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMod97(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"0", 0},
+		{"97", 0},
+		{"98", 1},
+		{"A", 10},
+		{"Z", 35},
+		{"370400440532013000DE89", 1},
+	}
+	for _, test := range tests {
+		if got := mod97(test.s); got != test.want {
+			t.Errorf("mod97(%q) = %d, want %d", test.s, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+const (
+	CashbackCredit = "credit" // The transaction adds the amount to the balance
+	CashbackDebit  = "debit"  // The transaction subtracts the amount from the balance
+
+	cashbackAdjustmentReason = "Balance set" // cashbackAdjustmentReason is the reason of the transactions recorded when the balance is overwritten
+)
+
+var (
+	// ErrCashbackReferenceConflict is returned when a transaction with the same external reference but other details was already posted
+	ErrCashbackReferenceConflict = errors.New("a different cashback transaction was already posted with this reference")
+	// ErrInsufficientCashback is returned when a debit is larger than the balance
+	ErrInsufficientCashback = errors.New("the cashback balance is lower than the debit")
+	// ErrCashbackCurrencyMismatch is returned when the currency of a transaction is not the currency of the pass balance
+	ErrCashbackCurrencyMismatch = errors.New("the currency doesn't match the currency of the cashback balance")
+)
+
+// CashbackPosting is the result of posting a cashback transaction
+type CashbackPosting struct {
+	Transaction CashbackTransaction
+	Pass        Pass
+	PushJob     PushJob
+	Replayed    bool // Replayed is true when the transaction was already posted, the balance didn't change and no push was queued
+}
+
+// PostCashbackTransaction records the transaction on the company's pass and updates its balance, regenerates the pass
+// and queues the push about the update in the same transaction. Posting a transaction with the external reference
+// of a posted one returns the posted one without changing the balance, whatever the version
+func PostCashbackTransaction(db *gorm.DB, companyID string, transaction CashbackTransaction, version int64) (CashbackPosting, error) {
+	if transaction.Type != CashbackCredit && transaction.Type != CashbackDebit {
+		return CashbackPosting{}, fmt.Errorf("unknown cashback transaction type %q", transaction.Type)
+	}
+	if transaction.Amount <= 0 {
+		return CashbackPosting{}, errors.New("the amount of a cashback transaction must be positive")
+	}
+
+	posting := CashbackPosting{Transaction: transaction}
+	pass, job, err := updatePass(db, companyID, func(tx *gorm.DB) (Pass, bool, error) {
+		var pass Pass
+		if err := tx.Where("company_id = ?", companyID).First(&pass).Error; err != nil {
+			return Pass{}, false, err
+		}
+
+		if transaction.ExternalReference != "" {
+			var posted CashbackTransaction
+			rec := tx.Where("pass_id = ? AND external_reference = ?", pass.ID, transaction.ExternalReference).Limit(1).Find(&posted)
+			if rec.Error != nil {
+				return Pass{}, false, rec.Error
+			}
+			if rec.RowsAffected > 0 {
+				if err := checkReplayedTransaction(posted, transaction); err != nil {
+					return Pass{}, false, err
+				}
+				posting.Transaction = posted
+				posting.Replayed = true
+				return pass, false, nil
+			}
+		}
+
+		if version != 0 && pass.Version != version {
+			return Pass{}, false, ErrPassVersionConflict
+		}
+		if transaction.Currency != pass.Cashback.Currency {
+			return Pass{}, false, ErrCashbackCurrencyMismatch
+		}
+
+		transaction.PassID = pass.ID
+		if err := tx.Create(&transaction).Error; err != nil {
+			return Pass{}, false, err
+		}
+		posting.Transaction = transaction
+
+		updates := map[string]interface{}{}
+		if transaction.Type == CashbackCredit {
+			updates["last_cashback_amount"] = transaction.Amount
+			updates["last_cashback_currency"] = transaction.Currency
+			updates["last_cashback_reason"] = transaction.Reason
+			updates["last_cashback_at"] = transaction.CreatedAt
+		}
+		if err := applyCashbackBalance(tx, &pass, updates); err != nil {
+			return Pass{}, false, err
+		}
+		return pass, true, nil
+	})
+	if err != nil {
+		return CashbackPosting{}, err
+	}
+
+	posting.Pass = pass
+	posting.PushJob = job
+	return posting, nil
+}
+
+// checkReplayedTransaction returns ErrCashbackReferenceConflict unless the transaction posted again with the external reference
+// of a posted one is the same transaction. The reason can differ, it only describes the transaction
+func checkReplayedTransaction(posted, transaction CashbackTransaction) error {
+	if posted.Type != transaction.Type || posted.Amount != transaction.Amount || posted.Currency != transaction.Currency {
+		return ErrCashbackReferenceConflict
+	}
+	return nil
+}
+
+// cashbackLedger is the sum of the cashback transactions of a pass
+type cashbackLedger struct {
+	Balance    int64
+	Currencies int64  // Currencies is the number of currencies of the transactions
+	Currency   string // Currency is the currency of the transactions, if there is one
+}
+
+// RecordCashbackAdjustment records the difference between the balance of the pass and the sum of its transactions
+// as a transaction with the reason, so the balance set directly stays explained by the ledger
+func RecordCashbackAdjustment(tx *gorm.DB, pass Pass, reason string) error {
+	var ledger cashbackLedger
+	if err := tx.Model(&CashbackTransaction{}).
+		Select("COALESCE(SUM(CASE WHEN type = ? THEN -amount ELSE amount END), 0) AS balance, COUNT(DISTINCT currency) AS currencies, MIN(currency) AS currency", CashbackDebit).
+		Where("pass_id = ?", pass.ID).
+		Scan(&ledger).Error; err != nil {
+		return err
+	}
+
+	adjustment, ok, err := cashbackAdjustment(pass, ledger, reason)
+	if err != nil || !ok {
+		return err
+	}
+
+	return tx.Create(&adjustment).Error
+}
+
+// cashbackAdjustment returns the transaction that makes the ledger explain the balance of the pass,
+// and false if the ledger already explains it
+func cashbackAdjustment(pass Pass, ledger cashbackLedger, reason string) (CashbackTransaction, bool, error) {
+	if ledger.Currencies > 1 || (ledger.Currencies == 1 && ledger.Currency != pass.Cashback.Currency) {
+		return CashbackTransaction{}, false, ErrCashbackCurrencyMismatch
+	}
+
+	difference := pass.Cashback.Amount - ledger.Balance
+	if difference == 0 {
+		return CashbackTransaction{}, false, nil
+	}
+
+	adjustment := CashbackTransaction{
+		PassID:   pass.ID,
+		Type:     CashbackCredit,
+		Amount:   difference,
+		Currency: pass.Cashback.Currency,
+		Reason:   reason,
+	}
+	if difference < 0 {
+		adjustment.Type = CashbackDebit
+		adjustment.Amount = -difference
+	}
+
+	return adjustment, true, nil
+}
+
+// applyCashbackBalance sets the balance of the pass to the sum of its transactions, together with the other updates
+func applyCashbackBalance(tx *gorm.DB, pass *Pass, updates map[string]interface{}) error {
+	var balance int64
+	if err := tx.Model(&CashbackTransaction{}).
+		Select("COALESCE(SUM(CASE WHEN type = ? THEN -amount ELSE amount END), 0)", CashbackDebit).
+		Where("pass_id = ?", pass.ID).
+		Scan(&balance).Error; err != nil {
+		return err
+	}
+	if balance < 0 {
+		return ErrInsufficientCashback
+	}
+
+	updates["cashback_amount"] = balance
+	return updatePassColumns(tx, pass, updates)
+}
+
+// GetCashbackTransactions returns the most recent cashback transactions of the pass, newest first
+func GetCashbackTransactions(db *gorm.DB, passID uuid.UUID, limit int) ([]CashbackTransaction, error) {
+	var transactions []CashbackTransaction
+	if err := db.Where("pass_id = ?", passID).Order("created_at DESC, id DESC").Limit(limit).Find(&transactions).Error; err != nil {
+		return nil, err
+	}
+
+	return transactions, nil
+}
+
+// backfillCashbackLedger records the balances that are not explained by the cashback transactions,
+// like the ones of the passes created before the ledger existed, as opening balance transactions
+func backfillCashbackLedger(db *gorm.DB) error {
+	rec := db.Exec(`INSERT INTO cashback_transactions (pass_id, type, amount, currency, reason, external_reference, created_at)
+		SELECT p.id,
+			CASE WHEN p.cashback_amount > COALESCE(l.balance, 0) THEN ? ELSE ? END,
+			ABS(p.cashback_amount - COALESCE(l.balance, 0)),
+			p.cashback_currency, 'Opening balance', '', NOW()
+		FROM passes p
+		LEFT JOIN (
+			SELECT pass_id, SUM(CASE WHEN type = ? THEN -amount ELSE amount END) AS balance
+			FROM cashback_transactions
+			GROUP BY pass_id
+		) l ON l.pass_id = p.id
+		WHERE p.deleted_at IS NULL AND p.cashback_amount <> COALESCE(l.balance, 0)`,
+		CashbackCredit, CashbackDebit, CashbackDebit)
+	if rec.Error != nil {
+		return rec.Error
+	}
+
+	if rec.RowsAffected > 0 {
+		log.Info().Int64("Passes", rec.RowsAffected).Msg("Opening cashback balances recorded in the ledger")
+	}
+	return nil
+}
+
+func postCashbackTransactionRequest(c *gin.Context) {
+	companyID := c.PostForm("companyID")
+	transactionType := c.PostForm("type")
+	amount := c.PostForm("amount")
+	reference := c.PostForm("reference")
+
+	missingFields := []string{}
+	for field, value := range map[string]string{"companyID": companyID, "type": transactionType, "amount": amount, "reference": reference} {
+		if value == "" {
+			missingFields = append(missingFields, field)
+		}
+	}
+	if len(missingFields) > 0 {
+		sort.Strings(missingFields)
+		c.JSON(400, gin.H{
+			"message": "Missing required fields",
+			"fields":  missingFields,
+		})
+		return
+	}
+
+	fieldErrors := []FieldError{}
+	if transactionType != CashbackCredit && transactionType != CashbackDebit {
+		fieldErrors = append(fieldErrors, FieldError{Field: "type", Reason: "type must be credit or debit"})
+	}
+	money, err := ParseMoney(amount, c.DefaultPostForm("currency", DefaultCurrency))
+	if err != nil {
+		fieldErrors = append(fieldErrors, FieldError{Field: "amount", Reason: err.Error()})
+	} else if money.Amount == 0 {
+		fieldErrors = append(fieldErrors, FieldError{Field: "amount", Reason: "amount must be positive"})
+	}
+	version, err := formVersion(c)
+	if err != nil {
+		fieldErrors = append(fieldErrors, FieldError{Field: "version", Reason: err.Error()})
+	}
+	if len(fieldErrors) > 0 {
+		c.JSON(400, gin.H{
+			"message": "Invalid fields",
+			"errors":  fieldErrors,
+		})
+		return
+	}
+
+	posting, err := PostCashbackTransaction(db, companyID, CashbackTransaction{
+		Type:              transactionType,
+		Amount:            money.Amount,
+		Currency:          money.Currency,
+		Reason:            c.PostForm("reason"),
+		ExternalReference: reference,
+	}, version)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(404, gin.H{
+			"message":   "Pass not found",
+			"companyID": companyID,
+		})
+		return
+	case errors.Is(err, ErrCashbackReferenceConflict):
+		c.JSON(409, gin.H{
+			"message":   err.Error(),
+			"reference": reference,
+		})
+		return
+	case errors.Is(err, ErrPassVersionConflict):
+		respondVersionConflict(c, companyID)
+		return
+	case errors.Is(err, ErrInsufficientCashback), errors.Is(err, ErrCashbackCurrencyMismatch):
+		c.JSON(422, gin.H{
+			"message": err.Error(),
+		})
+		return
+	case err != nil:
+		log.Error().Err(err).Msg("Failed to post cashback transaction")
+		c.JSON(500, gin.H{
+			"message":   "Failed to post cashback transaction",
+			"error":     err.Error(),
+			"companyID": companyID,
+		})
+		return
+	}
+
+	status := http.StatusCreated
+	message := "Cashback transaction was posted successfully"
+	if posting.Replayed {
+		status = http.StatusOK
+		message = "Cashback transaction was already posted"
+	}
+
+	c.JSON(status, gin.H{
+		"message":     message,
+		"transaction": posting.Transaction,
+		"balance":     posting.Pass.Cashback,
+		"version":     posting.Pass.Version,
+		"replayed":    posting.Replayed,
+		"pushJobID":   posting.PushJob.ID,
+	})
+}
+
+func listCashbackTransactionsRequest(c *gin.Context) {
+	companyID := c.Query("companyID")
+	if companyID == "" {
+		c.JSON(400, gin.H{
+			"message": "Missing required fields",
+			"fields":  []string{"companyID"},
+		})
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		c.JSON(400, gin.H{
+			"message": "Invalid limit",
+		})
+		return
+	}
+
+	pass, err := GetPassByCompanyID(db, companyID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{
+			"message":   "Pass not found",
+			"companyID": companyID,
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{
+			"message":   "Failed to get pass",
+			"error":     err.Error(),
+			"companyID": companyID,
+		})
+		return
+	}
+
+	transactions, err := GetCashbackTransactions(db, pass.ID, limit)
+	if err != nil {
+		c.JSON(500, gin.H{
+			"message": "Failed to get cashback transactions",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"message":      "Cashback transactions were retrieved successfully",
+		"companyID":    companyID,
+		"balance":      pass.Cashback,
+		"transactions": transactions,
+	})
+}
+
+// lastCashbackDate formats the time of the most recent cashback accrual of the pass as an ISO 8601 date for Wallet to format, or returns an empty string if there is none
+func lastCashbackDate(pass Pass) string {
+	if pass.LastCashbackAt == nil {
+		return ""
+	}
+	return pass.LastCashbackAt.UTC().Format(time.RFC3339)
+}
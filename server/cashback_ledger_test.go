@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+func TestCheckReplayedTransaction(t *testing.T) {
+	posted := CashbackTransaction{Type: CashbackCredit, Amount: 500, Currency: "EUR", Reason: "Purchase", ExternalReference: "order-1"}
+
+	tests := []struct {
+		name   string
+		change func(transaction *CashbackTransaction)
+		err    error
+	}{
+		{"same transaction", func(transaction *CashbackTransaction) {}, nil},
+		{"other reason", func(transaction *CashbackTransaction) { transaction.Reason = "Refund" }, nil},
+		{"other type", func(transaction *CashbackTransaction) { transaction.Type = CashbackDebit }, ErrCashbackReferenceConflict},
+		{"other amount", func(transaction *CashbackTransaction) { transaction.Amount = 501 }, ErrCashbackReferenceConflict},
+		{"other currency", func(transaction *CashbackTransaction) { transaction.Currency = "USD" }, ErrCashbackReferenceConflict},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transaction := posted
+			test.change(&transaction)
+			if err := checkReplayedTransaction(posted, transaction); !errors.Is(err, test.err) {
+				t.Errorf("checkReplayedTransaction = %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestPostCashbackTransactionValidation(t *testing.T) {
+	// Invalid transactions are rejected before the database is used
+	for _, transaction := range []CashbackTransaction{
+		{Type: "refund", Amount: 100, Currency: "EUR"},
+		{Type: CashbackCredit, Amount: 0, Currency: "EUR"},
+		{Type: CashbackDebit, Amount: -100, Currency: "EUR"},
+	} {
+		if _, err := PostCashbackTransaction(nil, "company", transaction, 0); err == nil {
+			t.Errorf("PostCashbackTransaction(%+v) accepted", transaction)
+		}
+	}
+}
+
+func TestCashbackAdjustment(t *testing.T) {
+	passID := uuid.New()
+
+	tests := []struct {
+		name       string
+		cashback   Money
+		ledger     cashbackLedger
+		adjustment CashbackTransaction
+		ok         bool
+		err        error
+	}{
+		{"empty ledger", Money{1250, "EUR"}, cashbackLedger{}, CashbackTransaction{Type: CashbackCredit, Amount: 1250}, true, nil},
+		{"balance raised", Money{1250, "EUR"}, cashbackLedger{1000, 1, "EUR"}, CashbackTransaction{Type: CashbackCredit, Amount: 250}, true, nil},
+		{"balance lowered", Money{0, "EUR"}, cashbackLedger{1000, 1, "EUR"}, CashbackTransaction{Type: CashbackDebit, Amount: 1000}, true, nil},
+		{"balance explained", Money{1000, "EUR"}, cashbackLedger{1000, 1, "EUR"}, CashbackTransaction{}, false, nil},
+		{"nothing to explain", Money{0, "EUR"}, cashbackLedger{}, CashbackTransaction{}, false, nil},
+		{"other currency", Money{1000, "USD"}, cashbackLedger{1000, 1, "EUR"}, CashbackTransaction{}, false, ErrCashbackCurrencyMismatch},
+		{"several currencies", Money{1000, "EUR"}, cashbackLedger{1000, 2, "EUR"}, CashbackTransaction{}, false, ErrCashbackCurrencyMismatch},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pass := Pass{ID: passID, Cashback: test.cashback}
+			adjustment, ok, err := cashbackAdjustment(pass, test.ledger, cashbackAdjustmentReason)
+			if !errors.Is(err, test.err) || ok != test.ok {
+				t.Fatalf("cashbackAdjustment = %v, %v, want %v, %v", ok, err, test.ok, test.err)
+			}
+			if !ok {
+				return
+			}
+			want := test.adjustment
+			want.PassID = passID
+			want.Currency = test.cashback.Currency
+			want.Reason = cashbackAdjustmentReason
+			if adjustment != want {
+				t.Errorf("adjustment = %+v, want %+v", adjustment, want)
+			}
+		})
+	}
+}
+
+func TestLastCashbackDate(t *testing.T) {
+	if date := lastCashbackDate(Pass{}); date != "" {
+		t.Errorf("lastCashbackDate without cashback = %q", date)
+	}
+	at := time.Date(2024, 3, 1, 12, 30, 0, 0, time.FixedZone("CET", 3600))
+	if date := lastCashbackDate(Pass{LastCashbackAt: &at}); date != "2024-03-01T11:30:00Z" {
+		t.Errorf("lastCashbackDate = %q", date)
+	}
+}
+
+func TestPostCashbackTransactionRequestValidation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name   string
+		form   url.Values
+		fields []string // fields are the missing or invalid fields
+	}{
+		{"empty", url.Values{}, []string{"amount", "companyID", "reference", "type"}},
+		{"no reference", url.Values{"companyID": {"c"}, "type": {"credit"}, "amount": {"5"}}, []string{"reference"}},
+		{"unknown type", url.Values{"companyID": {"c"}, "type": {"refund"}, "amount": {"5"}, "reference": {"r"}}, []string{"type"}},
+		{"zero amount", url.Values{"companyID": {"c"}, "type": {"credit"}, "amount": {"0"}, "reference": {"r"}}, []string{"amount"}},
+		{"invalid amount", url.Values{"companyID": {"c"}, "type": {"debit"}, "amount": {"5.001"}, "reference": {"r"}}, []string{"amount"}},
+		{"invalid version", url.Values{"companyID": {"c"}, "type": {"credit"}, "amount": {"5"}, "reference": {"r"}, "version": {"0"}}, []string{"version"}},
+		{"everything invalid", url.Values{"companyID": {"c"}, "type": {"refund"}, "amount": {"-5"}, "reference": {"r"}, "version": {"v"}}, []string{"type", "amount", "version"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			c.Request = httptest.NewRequest(http.MethodPost, "/pass/v1/cashback/transactions", strings.NewReader(test.form.Encode()))
+			c.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			postCashbackTransactionRequest(c)
+
+			if recorder.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want 400", recorder.Code)
+			}
+			var response struct {
+				Fields []string     `json:"fields"`
+				Errors []FieldError `json:"errors"`
+			}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			fields := response.Fields
+			for _, fieldError := range response.Errors {
+				fields = append(fields, fieldError.Field)
+			}
+			if !reflect.DeepEqual(fields, test.fields) {
+				t.Errorf("fields = %v, want %v", fields, test.fields)
+			}
+		})
+	}
+}
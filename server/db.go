@@ -1,43 +1,121 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-// Pass represents the pass model
+// Pass represents the pass model. Every company has one pass, deleted passes are kept for their cashback ledger
+// but are no longer found, so their serial numbers stop being served to the devices
 type Pass struct {
-	gorm.Model
-	ID          uuid.UUID `gorm:"type:uuid;primaryKey;default:uuid_generate_v4()"` // ID is the UUID of the pass
-	CompanyID   string    // CompanyID is the ID of the company
-	CompanyName string    // CompanyName is the name of the company
-	IBAN        string    // IBAN is the International Bank Account Number
-	BIC         string    // BIC is the Bank Identifier Code
-	Address     string    // Address is the address of the company
-	Cashback    string    // Cashback is the cashback balance in euros
-	CreatedAt   time.Time // Automatically managed by GORM for creation time
-	UpdatedAt   time.Time // Automatically managed by GORM for update time
-}
-
-type DeviceRegistration struct {
-	DeviceLibraryIdentifier string    `json:"deviceLibraryIdentifier"`
-	PassTypeIdentifier      string    `json:"passTypeIdentifier"`
-	SerialNumber            string    `json:"serialNumber"`
-	PushToken               string    `json:"pushToken"`
+	ID                  uuid.UUID      `gorm:"type:uuid;primaryKey;default:uuid_generate_v4()"`            // ID is the UUID of the pass, generated by the database
+	CompanyID           string         `gorm:"uniqueIndex:idx_passes_company_id,where:deleted_at IS NULL"` // CompanyID is the ID of the company
+	CompanyName         string         // CompanyName is the name of the company
+	IBAN                string         // IBAN is the International Bank Account Number
+	BIC                 string         // BIC is the Bank Identifier Code
+	Address             string         // Address is the address of the company
+	Cashback            Money          `gorm:"embedded;embeddedPrefix:cashback_"`      // Cashback is the cashback balance, the sum of the cashback transactions of the pass
+	LastCashback        Money          `gorm:"embedded;embeddedPrefix:last_cashback_"` // LastCashback is the amount of the most recent cashback accrual
+	LastCashbackReason  string         // LastCashbackReason is the reason of the most recent cashback accrual
+	LastCashbackAt      *time.Time     // LastCashbackAt is the time of the most recent cashback accrual
+	PaymentAmount       int64          // PaymentAmount is the fixed amount in euro cents of the payment QR code, 0 lets the payer choose it
+	PaymentReference    string         // PaymentReference is the creditor reference or remittance text of the payment QR code
+	Plan                string         // Plan is the customer's plan, selecting the design of the pass
+	Template            string         // Template is the name of the pass template overriding the design of the plan
+	AuthenticationToken string         `json:"-"`                  // AuthenticationToken is the secret of this pass that Wallet sends with its requests
+	Version             int64          `gorm:"not null;default:1"` // Version is incremented by every update, so updates of a pass changed since it was read fail
+	CreatedAt           time.Time      // Automatically managed by GORM for creation time
+	UpdatedAt           time.Time      // Automatically managed by GORM for update time
+	DeletedAt           gorm.DeletedAt `gorm:"index"` // DeletedAt is the time the pass was deleted, GORM leaves deleted passes out of the queries
+	PurgedAt            *time.Time     // PurgedAt is the time the registrations, push jobs and file of the deleted pass were removed
+}
+
+// ErrPassVersionConflict is returned when the pass was changed after it was read. The functions that change a pass
+// on behalf of a client take the version of the pass the client read, or 0 to change the current version
+var ErrPassVersionConflict = errors.New("the pass was changed by another request")
+
+// Device represents a device with Wallet that registered for pass updates
+type Device struct {
+	DeviceLibraryIdentifier string     `gorm:"primaryKey" json:"deviceLibraryIdentifier"`
+	PushToken               string     `gorm:"index" json:"pushToken"`
+	InvalidatedAt           *time.Time `json:"invalidatedAt"` // InvalidatedAt is the time APNs reported the push token as no longer valid
+	InvalidReason           string     `json:"invalidReason"` // InvalidReason is the APNs reason code for the invalidation
+	CreatedAt               time.Time  // Automatically managed by GORM for creation time
+	UpdatedAt               time.Time  // Automatically managed by GORM for update time
+}
+
+// Registration represents a pass registered on a device for updates
+type Registration struct {
+	ID                      uint      `gorm:"primaryKey" json:"-"`
+	DeviceLibraryIdentifier string    `gorm:"uniqueIndex:idx_registrations_device_pass" json:"deviceLibraryIdentifier"`
+	PassTypeIdentifier      string    `gorm:"uniqueIndex:idx_registrations_device_pass" json:"passTypeIdentifier"`
+	SerialNumber            string    `gorm:"uniqueIndex:idx_registrations_device_pass;index" json:"serialNumber"`
+	Device                  Device    `gorm:"foreignKey:DeviceLibraryIdentifier;constraint:OnDelete:CASCADE" json:"-"`
 	CreatedAt               time.Time // Automatically managed by GORM for creation time
-	UpdatedAt               time.Time // Automatically managed by GORM for update time
 }
 
-// BeforeCreate is a GORM hook that is called before creating a new pass. It sets the ID of the pass to a new UUID.
-func (pass *Pass) BeforeCreate(tx *gorm.DB) (err error) {
-	pass.ID = uuid.New()
-	return
+// PushTarget is a device to notify about the update of a pass
+type PushTarget struct {
+	DeviceLibraryIdentifier string
+	PassTypeIdentifier      string
+	PushToken               string
+}
+
+// PushJob is a notification about a pass update waiting in the push outbox
+type PushJob struct {
+	ID              uint      `gorm:"primaryKey" json:"id"`
+	SerialNumber    string    `gorm:"index" json:"serialNumber"`  // SerialNumber is the serial number of the updated pass
+	Status          string    `gorm:"index" json:"status"`        // Status is one of pending, sent or dead
+	Attempts        int       `json:"attempts"`                   // Attempts is the number of delivery attempts made so far
+	NextAttemptAt   time.Time `gorm:"index" json:"nextAttemptAt"` // NextAttemptAt is the earliest time of the next delivery attempt
+	LastError       string    `json:"lastError"`                  // LastError is the error of the last failed attempt
+	DevicesNotified int       `json:"devicesNotified"`            // DevicesNotified is the number of devices that received the push
+	CreatedAt       time.Time `json:"createdAt"`                  // Automatically managed by GORM for creation time
+	UpdatedAt       time.Time `json:"updatedAt"`                  // Automatically managed by GORM for update time
+}
+
+// APIKey represents a credential of an internal service for the pass API. Only the hash of the key is stored
+type APIKey struct {
+	ID         uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	Owner      string     `json:"owner"`                  // Owner is the service or team the key was issued to
+	Prefix     string     `json:"prefix"`                 // Prefix is the beginning of the key that identifies it in lists and logs
+	Hash       string     `gorm:"uniqueIndex" json:"-"`   // Hash is the SHA-256 hash of the key
+	Scopes     string     `json:"scopes"`                 // Scopes is the space separated list of the granted scopes
+	LastUsedAt *time.Time `json:"lastUsedAt"`             // LastUsedAt is the time of the last authorised request
+	RevokedAt  *time.Time `gorm:"index" json:"revokedAt"` // RevokedAt is the time the key was revoked or rotated
+	CreatedAt  time.Time  `json:"createdAt"`              // Automatically managed by GORM for creation time
+	UpdatedAt  time.Time  `json:"updatedAt"`              // Automatically managed by GORM for update time
+}
+
+// UsedDownloadLink is a single-use download link that was already used
+type UsedDownloadLink struct {
+	Signature string    `gorm:"primaryKey"` // Signature is the signature of the link
+	ExpiresAt time.Time `gorm:"index"`      // ExpiresAt is the expiry of the link, after which the record is useless
+	CreatedAt time.Time // Automatically managed by GORM for creation time
+}
+
+// CashbackTransaction is a change of the cashback balance of a pass
+type CashbackTransaction struct {
+	ID       uint      `gorm:"primaryKey" json:"id"`
+	PassID   uuid.UUID `gorm:"type:uuid;index;uniqueIndex:idx_cashback_transactions_reference,where:external_reference <> ''" json:"passID"`
+	Type     string    `json:"type"`     // Type is CashbackCredit or CashbackDebit
+	Amount   int64     `json:"amount"`   // Amount is the positive amount in the minor unit of the currency
+	Currency string    `json:"currency"` // Currency is the ISO 4217 code of the currency of the pass balance
+	Reason   string    `json:"reason"`   // Reason describes why the balance changed
+	// ExternalReference identifies the transaction in the caller's system, so posting it again has no effect
+	ExternalReference string    `gorm:"uniqueIndex:idx_cashback_transactions_reference" json:"externalReference"`
+	CreatedAt         time.Time `gorm:"index" json:"createdAt"`
 }
 
 // getDBConnection returns a new database connection
@@ -96,45 +174,113 @@ func getDBConnection() (*gorm.DB, error) {
 		log.Info().Msg("uuid-ossp extension created successfully")
 	}
 
+	// The duplicate passes have to be removed before the unique index on company_id is created
+	if err := dedupePasses(db); err != nil {
+		return nil, fmt.Errorf("error removing duplicate passes: %v", err)
+	}
+
 	// Migrate the schema
-	db.AutoMigrate(&Pass{}, &DeviceRegistration{})
+	if err := db.AutoMigrate(&Pass{}, &Device{}, &Registration{}, &PushJob{}, &APIKey{}, &UsedDownloadLink{}, &CashbackTransaction{}); err != nil {
+		return nil, fmt.Errorf("error migrating the schema: %v", err)
+	}
+
+	if err := migrateDeviceRegistrations(db); err != nil {
+		return nil, fmt.Errorf("error migrating device registrations: %v", err)
+	}
+
+	if err := migrateCashbackStrings(db); err != nil {
+		return nil, fmt.Errorf("error migrating cashback amounts: %v", err)
+	}
+
+	if err := backfillCashbackLedger(db); err != nil {
+		return nil, fmt.Errorf("error backfilling the cashback ledger: %v", err)
+	}
 
 	return db, nil
 }
 
-// AddNewPass creates a new pass with the given data and saves it in the database. It returns the pass data
-func AddNewPass(db *gorm.DB, companyID, cashback, companyName, iban, bic, address string) (Pass, error) {
-	// Create a new pass
-	pass := Pass{
-		CompanyID:   companyID,
-		CompanyName: companyName,
-		IBAN:        iban,
-		BIC:         bic,
-		Address:     address,
-		Cashback:    cashback,
+// AddNewPass saves the pass with the given data in the database, updating the company's pass if it already exists.
+// The cashback of an existing pass is set only when setCashback is true.
+// It returns the pass data and whether the pass was created
+func AddNewPass(db *gorm.DB, pass Pass, setCashback bool) (Pass, bool, error) {
+	companyID := pass.CompanyID
+
+	authenticationToken, err := GenerateToken()
+	if err != nil {
+		return Pass{}, false, err
 	}
 
-	// Check if a pass with the given companyID already exists, if not create a new one
-	if err := db.Where(Pass{CompanyID: companyID}).Assign(pass).FirstOrCreate(&pass).Error; err != nil {
-		return Pass{}, err
+	// Check if a pass with the given companyID already exists, if not create a new one.
+	// The authentication token is set only on creation, so the passes already installed on devices stay valid
+	var existing Pass
+	rec := db.Where("company_id = ?", companyID).Limit(1).Find(&existing)
+	if rec.Error != nil {
+		return Pass{}, false, rec.Error
+	}
+
+	created := rec.RowsAffected == 0
+	if created {
+		pass.AuthenticationToken = authenticationToken
+		if err := db.Create(&pass).Error; err != nil {
+			return Pass{}, false, err
+		}
+	} else {
+		// Like the fields of an update, the empty fields of the pass keep their stored values.
+		// A cashback that is set is written even when it is 0, so it resets the balance
+		updates := map[string]interface{}{}
+		if setCashback {
+			updates["cashback_amount"] = pass.Cashback.Amount
+			updates["cashback_currency"] = pass.Cashback.Currency
+		}
+		if pass.CompanyName != "" {
+			updates["company_name"] = pass.CompanyName
+		}
+		if pass.IBAN != "" {
+			updates["iban"] = pass.IBAN
+		}
+		if pass.BIC != "" {
+			updates["bic"] = pass.BIC
+		}
+		if pass.Address != "" {
+			updates["address"] = pass.Address
+		}
+		if pass.PaymentAmount != 0 {
+			updates["payment_amount"] = pass.PaymentAmount
+		}
+		if pass.PaymentReference != "" {
+			updates["payment_reference"] = pass.PaymentReference
+		}
+		if pass.Plan != "" {
+			updates["plan"] = pass.Plan
+		}
+		if pass.Template != "" {
+			updates["template"] = pass.Template
+		}
+		if err := updatePassColumns(db, &existing, updates); err != nil {
+			return Pass{}, false, err
+		}
+		pass = existing
 	}
 
 	log.Debug().
 		Interface("Pass", pass).
 		Msg("New pass created/updated")
 
-	return pass, nil
+	return pass, created, nil
 }
 
 // UpdatePassByCompanyID updates the cashback of the pass with the given companyID
-func UpdatePassByCompanyID(db *gorm.DB, companyID, cashback string) (Pass, error) {
+func UpdatePassByCompanyID(db *gorm.DB, companyID string, cashback Money, version int64) (Pass, error) {
 	// Update cashback
-	var pass Pass
-	if err := db.Where("company_id = ?", companyID).First(&pass).Error; err != nil {
+	pass, err := getPassForUpdate(db, companyID, version)
+	if err != nil {
 		return Pass{}, err
 	}
 
-	if err := db.Model(&pass).Update("cashback", cashback).Error; err != nil {
+	if err := updatePassColumns(db, &pass, map[string]interface{}{
+		"cashback_amount":   cashback.Amount,
+		"cashback_currency": cashback.Currency,
+	}); err != nil {
 		return Pass{}, err
 	}
 
@@ -145,6 +291,68 @@ func UpdatePassByCompanyID(db *gorm.DB, companyID, cashback string) (Pass, error
 	return pass, nil
 }
 
+// UpdatePassPlanByCompanyID changes the plan of the pass with the given companyID.
+// The template override is cleared, so the pass gets the design of the new plan
+func UpdatePassPlanByCompanyID(db *gorm.DB, companyID, plan string, version int64) (Pass, error) {
+	pass, err := getPassForUpdate(db, companyID, version)
+	if err != nil {
+		return Pass{}, err
+	}
+
+	if err := updatePassColumns(db, &pass, map[string]interface{}{"plan": plan, "template": ""}); err != nil {
+		return Pass{}, err
+	}
+
+	log.Debug().
+		Interface("Pass", pass).
+		Msg("Plan updated")
+
+	return pass, nil
+}
+
+// getPassForUpdate returns the pass with the given companyID, or ErrPassVersionConflict if the version is not 0
+// and the pass was changed since the client read that version
+func getPassForUpdate(db *gorm.DB, companyID string, version int64) (Pass, error) {
+	var pass Pass
+	if err := db.Where("company_id = ?", companyID).First(&pass).Error; err != nil {
+		return Pass{}, err
+	}
+	if version != 0 && pass.Version != version {
+		return Pass{}, ErrPassVersionConflict
+	}
+
+	return pass, nil
+}
+
+// updatePassColumns applies the updates, a map of columns or a Pass with the fields to change, to the pass and increments its version.
+// It returns ErrPassVersionConflict if the version of the pass changed since it was read. The pass is reloaded after the update
+func updatePassColumns(db *gorm.DB, pass *Pass, updates interface{}) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		// Claiming the next version locks the row until the end of the transaction
+		rec := tx.Model(&Pass{}).
+			Where("id = ? AND version = ?", pass.ID, pass.Version).
+			UpdateColumn("version", gorm.Expr("version + 1"))
+		if rec.Error != nil {
+			return rec.Error
+		}
+		if rec.RowsAffected == 0 {
+			return ErrPassVersionConflict
+		}
+
+		if err := tx.Model(&Pass{}).Where("id = ?", pass.ID).Updates(updates).Error; err != nil {
+			return err
+		}
+
+		return tx.Where("id = ?", pass.ID).First(pass).Error
+	})
+}
+
+// LockCompany takes a lock on the company until the end of the transaction, so concurrent changes of its pass
+// are serialised between all the server replicas
+func LockCompany(tx *gorm.DB, companyID string) error {
+	return tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", companyID).Error
+}
+
 // GetPassByCompanyID returns the pass with the given companyID
 func GetPassByCompanyID(db *gorm.DB, companyID string) (Pass, error) {
 	var pass Pass
@@ -155,63 +363,372 @@ func GetPassByCompanyID(db *gorm.DB, companyID string) (Pass, error) {
 	return pass, nil
 }
 
-func RegisterDevice(db *gorm.DB, deviceLibraryIdentifier, serialNumber, pushToken string) (DeviceRegistration, error, bool) {
-	deviceReg := DeviceRegistration{
-		DeviceLibraryIdentifier: deviceLibraryIdentifier,
-		PassTypeIdentifier:      "pass.com.finom.bank2wallet",
-		SerialNumber:            serialNumber,
-		PushToken:               pushToken,
+// dedupePasses deletes the passes of the companies that have more than one, created before company_id was unique.
+// The most recently updated pass of every company is kept
+func dedupePasses(db *gorm.DB) error {
+	if !db.Migrator().HasTable("passes") || !db.Migrator().HasColumn("passes", "deleted_at") {
+		return nil
+	}
+
+	rec := db.Exec(`UPDATE passes SET deleted_at = NOW()
+		WHERE id IN (
+			SELECT id FROM (
+				SELECT id, ROW_NUMBER() OVER (PARTITION BY company_id ORDER BY updated_at DESC, created_at DESC) AS rank
+				FROM passes
+				WHERE deleted_at IS NULL
+			) ranked
+			WHERE rank > 1
+		)`)
+	if rec.Error != nil {
+		return rec.Error
+	}
+
+	if rec.RowsAffected > 0 {
+		log.Warn().Int64("Passes", rec.RowsAffected).Msg("Duplicate passes of companies deleted, the latest pass of every company was kept")
 	}
+	return nil
+}
 
-	rec := db.Where(DeviceRegistration{SerialNumber: serialNumber}).Find(&deviceReg)
-	exists := rec.RowsAffected > 0
-	if exists {
-		if deviceReg.PushToken != pushToken {
-			if err := db.Model(&deviceReg).Update("push_token", pushToken).Error; err != nil {
-				return DeviceRegistration{}, err, false
+// purgeDeletedPasses removes what the deleted passes that were not purged yet left behind, like the duplicate passes
+// deleted on startup or the passes whose files could not be deleted
+func purgeDeletedPasses(db *gorm.DB) error {
+	var passes []Pass
+	if err := db.Unscoped().Where("deleted_at IS NOT NULL AND purged_at IS NULL").Find(&passes).Error; err != nil {
+		return err
+	}
+	if len(passes) == 0 {
+		return nil
+	}
+
+	return purgePasses(db, passes)
+}
+
+// purgePasses removes the registrations of the deleted passes, the devices that had no other registered passes,
+// their pending push jobs and their pkpass files, and marks the passes as purged. The rows of the deleted passes
+// and their cashback transactions are kept. A pass whose file could not be deleted is not marked, so it is purged again on the next startup
+func purgePasses(db *gorm.DB, passes []Pass) error {
+	serialNumbers := make([]string, len(passes))
+	for i, pass := range passes {
+		serialNumbers[i] = pass.ID.String()
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var devices []string
+		if err := tx.Model(&Registration{}).Where("serial_number IN ?", serialNumbers).
+			Distinct().Pluck("device_library_identifier", &devices).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("serial_number IN ?", serialNumbers).Delete(&Registration{}).Error; err != nil {
+			return err
+		}
+		if len(devices) > 0 {
+			if err := tx.Where("device_library_identifier IN ? AND NOT EXISTS (SELECT 1 FROM registrations WHERE registrations.device_library_identifier = devices.device_library_identifier)", devices).
+				Delete(&Device{}).Error; err != nil {
+				return err
 			}
 		}
-	} else {
-		if err := db.Create(&deviceReg).Error; err != nil {
-			return DeviceRegistration{}, err, false
+		return tx.Where("serial_number IN ? AND status = ?", serialNumbers, PushJobPending).Delete(&PushJob{}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	purged := make([]uuid.UUID, 0, len(passes))
+	for _, pass := range passes {
+		// There is no storage in the render delivery mode
+		if passStore != nil {
+			if err := passStore.Delete(context.Background(), passBlobKey(pass)); err != nil {
+				log.Warn().Err(err).Str("SerialNumber", pass.ID.String()).Msg("Error deleting the pkpass file of a deleted pass, it is retried on the next startup")
+				continue
+			}
 		}
+		purged = append(purged, pass.ID)
+	}
+	if len(purged) == 0 {
+		return nil
+	}
+
+	if err := db.Unscoped().Model(&Pass{}).Where("id IN ?", purged).UpdateColumn("purged_at", time.Now()).Error; err != nil {
+		return err
 	}
 
-	return deviceReg, nil, exists
+	log.Info().Int("Passes", len(purged)).Msg("Registrations, push jobs and files of deleted passes removed")
+	return nil
 }
 
-func GetPassesByDeviceID(db *gorm.DB, deviceLibraryIdentifier string) ([]string, error) {
-	var deviceRegs []DeviceRegistration
-	if err := db.Where("device_library_identifier = ?", deviceLibraryIdentifier).Find(&deviceRegs).Error; err != nil {
-		return nil, err
+// migrateDeviceRegistrations moves the rows of the old device_registrations table, which stored the push token per registration,
+// to the devices and registrations tables and drops it. The latest push token of every device is kept
+func migrateDeviceRegistrations(db *gorm.DB) error {
+	if !db.Migrator().HasTable("device_registrations") {
+		return nil
 	}
 
-	serialNumbers := make([]string, 0, len(deviceRegs))
-	for _, deviceReg := range deviceRegs {
-		serialNumbers = append(serialNumbers, deviceReg.SerialNumber)
+	// The tables of the databases created before the push tokens were invalidated don't have the invalidation columns
+	invalidatedAt, invalidReason := "NULL", "''"
+	if db.Migrator().HasColumn("device_registrations", "invalidated_at") {
+		invalidatedAt = "invalidated_at"
+	}
+	if db.Migrator().HasColumn("device_registrations", "invalid_reason") {
+		invalidReason = "COALESCE(invalid_reason, '')"
 	}
 
-	return serialNumbers, nil
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(`INSERT INTO devices (device_library_identifier, push_token, invalidated_at, invalid_reason, created_at, updated_at)
+			SELECT DISTINCT ON (device_library_identifier) device_library_identifier, push_token, ` + invalidatedAt + `, ` + invalidReason + `, created_at, updated_at
+			FROM device_registrations
+			ORDER BY device_library_identifier, updated_at DESC
+			ON CONFLICT DO NOTHING`).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Exec(`INSERT INTO registrations (device_library_identifier, pass_type_identifier, serial_number, created_at)
+			SELECT device_library_identifier, pass_type_identifier, serial_number, MIN(created_at)
+			FROM device_registrations
+			GROUP BY device_library_identifier, pass_type_identifier, serial_number
+			ON CONFLICT DO NOTHING`).Error; err != nil {
+			return err
+		}
+
+		log.Info().Msg("Device registrations migrated to the devices and registrations tables")
+
+		return tx.Migrator().DropTable("device_registrations")
+	})
 }
 
-func GetUpdatedPasses(db *gorm.DB, deviceLibraryIdentifier, passesUpdatedSince string) ([]string, error) {
+// migrateCashbackStrings converts the cashback of the passes stored as euro strings like "12€" to amounts in cents,
+// then drops the old cashback column
+func migrateCashbackStrings(db *gorm.DB) error {
+	if !db.Migrator().HasColumn("passes", "cashback") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		var rows []struct {
+			ID       uuid.UUID
+			Cashback string
+		}
+		if err := tx.Raw("SELECT id, cashback FROM passes WHERE cashback IS NOT NULL").Scan(&rows).Error; err != nil {
+			return err
+		}
+
+		for _, row := range rows {
+			amount := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(row.Cashback), "€"))
+			if amount == "" {
+				amount = "0"
+			}
+			cashback, err := ParseMoney(amount, "EUR")
+			if err != nil {
+				log.Warn().Err(err).Str("PassID", row.ID.String()).Str("Cashback", row.Cashback).Msg("Invalid cashback, migrated as 0")
+				cashback = Money{Currency: "EUR"}
+			}
+
+			if err := tx.Exec("UPDATE passes SET cashback_amount = ?, cashback_currency = ? WHERE id = ?",
+				cashback.Amount, cashback.Currency, row.ID).Error; err != nil {
+				return err
+			}
+		}
+
+		log.Info().Int("Passes", len(rows)).Msg("Cashback strings migrated to amounts in cents")
+
+		return tx.Migrator().DropColumn("passes", "cashback")
+	})
+}
+
+// GetPassBySerialNumber returns the pass with the given serial number
+func GetPassBySerialNumber(db *gorm.DB, serialNumber string) (Pass, error) {
+	id, err := uuid.Parse(serialNumber)
+	if err != nil {
+		return Pass{}, gorm.ErrRecordNotFound
+	}
+
+	var pass Pass
+	if err := db.Where("id = ?", id).First(&pass).Error; err != nil {
+		return Pass{}, err
+	}
+
+	return pass, nil
+}
+
+// backfillAuthenticationTokens generates authentication tokens for the passes created when every pass shared AUTH_TOKEN.
+// The passes are regenerated, so the files downloaded again carry the new token. No push is queued: the installed passes
+// still carry the shared token, so Wallet couldn't fetch the update. It needs the templates, the storage and the signer
+func backfillAuthenticationTokens(db *gorm.DB) error {
 	var passes []Pass
-	if err := db.Where("updated_at > ?", passesUpdatedSince).Find(&passes).Error; err != nil {
+	if err := db.Where("authentication_token IS NULL OR authentication_token = ''").Find(&passes).Error; err != nil {
+		return err
+	}
+
+	regenerated := 0
+	for _, pass := range passes {
+		authenticationToken, err := GenerateToken()
+		if err != nil {
+			return err
+		}
+		_, _, err = changePass(db, pass.CompanyID, false, func(tx *gorm.DB) (Pass, bool, error) {
+			var current Pass
+			if err := tx.Where("company_id = ?", pass.CompanyID).First(&current).Error; err != nil {
+				return Pass{}, false, err
+			}
+			if current.AuthenticationToken != "" {
+				return current, false, nil
+			}
+			err := updatePassColumns(tx, &current, map[string]interface{}{"authentication_token": authenticationToken})
+			return current, true, err
+		})
+		if err != nil {
+			// The pass keeps no token and is tried again on the next start
+			log.Error().Err(err).Str("SerialNumber", pass.ID.String()).Msg("Error generating the authentication token of the pass")
+			continue
+		}
+		regenerated++
+	}
+
+	if regenerated > 0 {
+		log.Info().Int("Passes", regenerated).Msg("Authentication tokens generated and passes regenerated for existing passes")
+	}
+
+	return nil
+}
+
+// RegisterDevice registers the pass on the device and saves the device's push token.
+// It returns true if the registration was created and false if the pass was already registered on the device
+func RegisterDevice(db *gorm.DB, deviceLibraryIdentifier, passTypeIdentifier, serialNumber, pushToken string) (bool, error) {
+	created := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Registering again makes the push token valid even if APNs rejected it before
+		device := Device{
+			DeviceLibraryIdentifier: deviceLibraryIdentifier,
+			PushToken:               pushToken,
+		}
+		if err := tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "device_library_identifier"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"push_token":     pushToken,
+				"invalidated_at": nil,
+				"invalid_reason": "",
+				"updated_at":     time.Now(),
+			}),
+		}).Create(&device).Error; err != nil {
+			return err
+		}
+
+		registration := Registration{
+			DeviceLibraryIdentifier: deviceLibraryIdentifier,
+			PassTypeIdentifier:      passTypeIdentifier,
+			SerialNumber:            serialNumber,
+		}
+		rec := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&registration)
+		if rec.Error != nil {
+			return rec.Error
+		}
+		created = rec.RowsAffected > 0
+
+		return nil
+	})
+
+	return created, err
+}
+
+// UnregisterDevice removes the registration of the pass on the device.
+// The device is removed as well when it has no registered passes left
+func UnregisterDevice(db *gorm.DB, deviceLibraryIdentifier, passTypeIdentifier, serialNumber string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("device_library_identifier = ? AND pass_type_identifier = ? AND serial_number = ?", deviceLibraryIdentifier, passTypeIdentifier, serialNumber).
+			Delete(&Registration{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Where("device_library_identifier = ? AND NOT EXISTS (SELECT 1 FROM registrations WHERE registrations.device_library_identifier = devices.device_library_identifier)", deviceLibraryIdentifier).
+			Delete(&Device{}).Error
+	})
+}
+
+// GetPushTargets returns the devices with a valid push token registered for the pass with the given serial number
+func GetPushTargets(db *gorm.DB, serialNumber string) ([]PushTarget, error) {
+	var targets []PushTarget
+	if err := db.Model(&Registration{}).
+		Select("registrations.device_library_identifier, registrations.pass_type_identifier, devices.push_token").
+		Joins("JOIN devices ON devices.device_library_identifier = registrations.device_library_identifier").
+		Where("registrations.serial_number = ? AND devices.invalidated_at IS NULL", serialNumber).
+		Scan(&targets).Error; err != nil {
 		return nil, err
 	}
 
+	return targets, nil
+}
+
+// InvalidatePushToken marks the devices with the given push token as invalid, so no more pushes are sent to them.
+// Devices updated after the invalidation time are kept, because they registered again since then.
+// It returns the number of invalidated devices
+func InvalidatePushToken(db *gorm.DB, pushToken, reason string, invalidatedAt time.Time) (int64, error) {
+	rec := db.Model(&Device{}).
+		Where("push_token = ? AND invalidated_at IS NULL AND updated_at < ?", pushToken, invalidatedAt).
+		UpdateColumns(map[string]interface{}{
+			"invalidated_at": invalidatedAt,
+			"invalid_reason": reason,
+		})
+	if rec.Error != nil {
+		return 0, rec.Error
+	}
+
+	return rec.RowsAffected, nil
+}
+
+// GetUpdatedPasses returns the serial numbers of the passes registered on the device that were updated after the given update tag,
+// along with the update tag to send back in the next check. An empty tag returns all the passes registered on the device
+func GetUpdatedPasses(db *gorm.DB, deviceLibraryIdentifier, passTypeIdentifier, passesUpdatedSince string) ([]string, string, error) {
+	query := db.Model(&Pass{}).
+		Select("passes.id, passes.updated_at").
+		Joins("JOIN registrations ON registrations.serial_number = passes.id::text").
+		Where("registrations.device_library_identifier = ? AND registrations.pass_type_identifier = ?", deviceLibraryIdentifier, passTypeIdentifier)
+
+	if passesUpdatedSince != "" {
+		updatedSince, err := decodeUpdateTag(passesUpdatedSince)
+		if err != nil {
+			return nil, "", err
+		}
+		query = query.Where("passes.updated_at > ?", updatedSince)
+	}
+
+	var passes []Pass
+	if err := query.Find(&passes).Error; err != nil {
+		return nil, "", err
+	}
+
 	serialNumbers := make([]string, 0, len(passes))
+	var lastUpdated time.Time
 	for _, pass := range passes {
 		serialNumbers = append(serialNumbers, pass.ID.String())
+		if pass.UpdatedAt.After(lastUpdated) {
+			lastUpdated = pass.UpdatedAt
+		}
 	}
 
-	return serialNumbers, nil
+	// updated_at is set before the pass is rendered and its transaction committed, so an update can become visible
+	// after a later one was returned. The tag never passes the safety window, so such updates are returned by the next check
+	if horizon := time.Now().Add(-updateTagSafetyWindow); lastUpdated.After(horizon) {
+		lastUpdated = horizon
+	}
+
+	return serialNumbers, encodeUpdateTag(lastUpdated), nil
 }
 
-func DeletePassOnDevice(db *gorm.DB, serialNumber string) error {
-	if err := db.Where("serial_number = ?", serialNumber).Delete(&DeviceRegistration{}).Error; err != nil {
-		return err
+// updateTagSafetyWindow is longer than the time between setting updated_at and committing a pass update,
+// including the clock differences of the replicas. The passes updated within the window are returned again by the next check
+const updateTagSafetyWindow = time.Minute
+
+// encodeUpdateTag returns the opaque update tag for the time of the update. Wallet sends it back as passesUpdatedSince
+func encodeUpdateTag(updatedAt time.Time) string {
+	return strconv.FormatInt(updatedAt.UnixMicro(), 10)
+}
+
+// decodeUpdateTag returns the time of the update encoded in the update tag
+func decodeUpdateTag(tag string) (time.Time, error) {
+	micros, err := strconv.ParseInt(tag, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid update tag %q", tag)
 	}
 
-	return nil
+	return time.UnixMicro(micros), nil
 }
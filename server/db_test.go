@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// testStatement is a statement built by the database of dryRunDB
+type testStatement struct {
+	SQL  string
+	Vars []interface{}
+}
+
+// dryRunDB returns a Postgres database that builds the statements without connecting or running them,
+// and the statements it built
+func dryRunDB(t *testing.T) (*gorm.DB, *[]testStatement) {
+	t.Helper()
+
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost"}), &gorm.Config{
+		DryRun:                 true,
+		DisableAutomaticPing:   true,
+		SkipDefaultTransaction: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statements := &[]testStatement{}
+	record := func(tx *gorm.DB) {
+		*statements = append(*statements, testStatement{SQL: tx.Statement.SQL.String(), Vars: tx.Statement.Vars})
+	}
+	callbacks := db.Callback()
+	for name, err := range map[string]error{
+		"create": callbacks.Create().After("gorm:create").Register("test:record", record),
+		"query":  callbacks.Query().After("gorm:query").Register("test:record", record),
+		"update": callbacks.Update().After("gorm:update").Register("test:record", record),
+		"delete": callbacks.Delete().After("gorm:delete").Register("test:record", record),
+		"raw":    callbacks.Raw().After("gorm:raw").Register("test:record", record),
+	} {
+		if err != nil {
+			t.Fatalf("registering the %s callback: %v", name, err)
+		}
+	}
+
+	return db, statements
+}
+
+func TestUpdateTag(t *testing.T) {
+	updatedAt := time.Date(2024, 3, 1, 12, 30, 15, 123456789, time.UTC)
+
+	tag := encodeUpdateTag(updatedAt)
+	if tag != "1709296215123456" {
+		t.Errorf("encodeUpdateTag = %s", tag)
+	}
+	decoded, err := decodeUpdateTag(tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The tag keeps the microseconds Postgres stores
+	if want := updatedAt.Truncate(time.Microsecond); !decoded.Equal(want) {
+		t.Errorf("decodeUpdateTag(%s) = %s, want %s", tag, decoded, want)
+	}
+
+	for _, tag := range []string{"", "abc", "1709296215.5", "2024-03-01T12:30:15Z", "99999999999999999999"} {
+		if _, err := decodeUpdateTag(tag); err == nil {
+			t.Errorf("decodeUpdateTag(%q) accepted", tag)
+		}
+	}
+}
+
+func TestGetUpdatedPassesFiltersByTag(t *testing.T) {
+	db, statements := dryRunDB(t)
+
+	if _, _, err := GetUpdatedPasses(db, "device", "pass.type", "abc"); err == nil {
+		t.Error("invalid update tag accepted")
+	}
+
+	serialNumbers, tag, err := GetUpdatedPasses(db, "device", "pass.type", "1709296215123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(serialNumbers) != 0 || tag != encodeUpdateTag(time.Time{}) {
+		t.Errorf("GetUpdatedPasses = %v, %s, want no passes", serialNumbers, tag)
+	}
+
+	if len(*statements) != 1 {
+		t.Fatalf("statements = %+v, want one query", *statements)
+	}
+	statement := (*statements)[0]
+	if !strings.Contains(statement.SQL, "passes.updated_at >") {
+		t.Errorf("query %s doesn't filter by the update tag", statement.SQL)
+	}
+	if !strings.Contains(statement.SQL, `"passes"."deleted_at" IS NULL`) {
+		t.Errorf("query %s returns deleted passes", statement.SQL)
+	}
+	if updatedSince, ok := statement.Vars[2].(time.Time); !ok || updatedSince.UnixMicro() != 1709296215123456 {
+		t.Errorf("query vars = %v", statement.Vars)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Errors returned for download links that can't be used
+var (
+	ErrDownloadLinkInvalid = errors.New("invalid download link signature")
+	ErrDownloadLinkExpired = errors.New("download link expired")
+	ErrDownloadLinkUsed    = errors.New("single-use download link already used")
+)
+
+// downloadLinkSecret is the key of the HMAC signing the download links
+var downloadLinkSecret []byte
+
+// downloadLinkTTL is how long the download links stay valid
+var downloadLinkTTL = 15 * time.Minute
+
+// DownloadLink is a signed link to download the pkpass file of a pass
+type DownloadLink struct {
+	URL       string    `json:"link"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	SingleUse bool      `json:"singleUse"`
+}
+
+// SignDownloadLink returns a link to download the pass that expires after downloadLinkTTL.
+// A single-use link can be downloaded only once
+func SignDownloadLink(serialNumber string, singleUse bool) DownloadLink {
+	expiresAt := time.Now().Add(downloadLinkTTL).Truncate(time.Second)
+
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expiresAt.Unix(), 10))
+	if singleUse {
+		query.Set("once", "1")
+	}
+	query.Set("signature", downloadLinkSignature(serialNumber, expiresAt.Unix(), singleUse))
+
+	return DownloadLink{
+		URL:       os.Getenv("WEB_SERVICE_URL") + "/pass/v1/download/" + serialNumber + ".pkpass?" + query.Encode(),
+		ExpiresAt: expiresAt,
+		SingleUse: singleUse,
+	}
+}
+
+// VerifyDownloadLink checks the signature and the expiry of the link to the pass
+func VerifyDownloadLink(serialNumber string, query url.Values) error {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return ErrDownloadLinkInvalid
+	}
+	singleUse := query.Get("once") == "1"
+
+	signature, err := hex.DecodeString(query.Get("signature"))
+	if err != nil {
+		return ErrDownloadLinkInvalid
+	}
+	expected, _ := hex.DecodeString(downloadLinkSignature(serialNumber, expires, singleUse))
+	if !hmac.Equal(signature, expected) {
+		return ErrDownloadLinkInvalid
+	}
+
+	if time.Now().After(time.Unix(expires, 0)) {
+		return ErrDownloadLinkExpired
+	}
+
+	return nil
+}
+
+// ConsumeDownloadLink marks a verified single-use link as used, returning ErrDownloadLinkUsed if it was used before.
+// Links that are not single-use can be used until they expire
+func ConsumeDownloadLink(db *gorm.DB, query url.Values) error {
+	if query.Get("once") != "1" {
+		return nil
+	}
+
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return ErrDownloadLinkInvalid
+	}
+
+	// The records of expired links are useless, because expired links are rejected anyway
+	if err := db.Where("expires_at < ?", time.Now()).Delete(&UsedDownloadLink{}).Error; err != nil {
+		return err
+	}
+
+	// The signature is decoded in any case of the hex digits, so the link is recorded with the canonical one
+	signature, err := hex.DecodeString(query.Get("signature"))
+	if err != nil {
+		return ErrDownloadLinkInvalid
+	}
+
+	rec := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&UsedDownloadLink{
+		Signature: hex.EncodeToString(signature),
+		ExpiresAt: time.Unix(expires, 0),
+	})
+	if rec.Error != nil {
+		return rec.Error
+	}
+	if rec.RowsAffected == 0 {
+		return ErrDownloadLinkUsed
+	}
+
+	return nil
+}
+
+// downloadLinkSignature returns the HMAC-SHA256 of the link parameters as a hex string
+func downloadLinkSignature(serialNumber string, expires int64, singleUse bool) string {
+	mac := hmac.New(sha256.New, downloadLinkSecret)
+	mac.Write([]byte(serialNumber + "\n" + strconv.FormatInt(expires, 10) + "\n" + strconv.FormatBool(singleUse)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
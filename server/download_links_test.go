@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func withDownloadLinkSecret(t *testing.T) {
+	secret := downloadLinkSecret
+	downloadLinkSecret = []byte("test secret")
+	t.Cleanup(func() { downloadLinkSecret = secret })
+}
+
+func signedQuery(t *testing.T, serialNumber string, singleUse bool) url.Values {
+	t.Helper()
+
+	link := SignDownloadLink(serialNumber, singleUse)
+	_, rawQuery, ok := strings.Cut(link.URL, "?")
+	if !ok {
+		t.Fatalf("link %s has no query", link.URL)
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return query
+}
+
+func TestSignDownloadLink(t *testing.T) {
+	withDownloadLinkSecret(t)
+	t.Setenv("WEB_SERVICE_URL", "https://passes.example.com")
+
+	link := SignDownloadLink("serial", true)
+	if !strings.HasPrefix(link.URL, "https://passes.example.com/pass/v1/download/serial.pkpass?") {
+		t.Errorf("URL = %s", link.URL)
+	}
+	if !link.SingleUse {
+		t.Error("the link is not single-use")
+	}
+	if ttl := time.Until(link.ExpiresAt); ttl <= downloadLinkTTL-2*time.Second || ttl > downloadLinkTTL {
+		t.Errorf("link expires in %s, want %s", ttl, downloadLinkTTL)
+	}
+}
+
+func TestVerifyDownloadLink(t *testing.T) {
+	withDownloadLinkSecret(t)
+
+	tests := []struct {
+		name   string
+		change func(query url.Values) string // change tampers with the link and returns the serial number it is used for
+		err    error
+	}{
+		{"valid", func(query url.Values) string { return "serial" }, nil},
+		{"upper case signature", func(query url.Values) string {
+			query.Set("signature", strings.ToUpper(query.Get("signature")))
+			return "serial"
+		}, nil},
+		{"other pass", func(query url.Values) string { return "other" }, ErrDownloadLinkInvalid},
+		{"extended expiry", func(query url.Values) string {
+			expires, _ := strconv.ParseInt(query.Get("expires"), 10, 64)
+			query.Set("expires", strconv.FormatInt(expires+3600, 10))
+			return "serial"
+		}, ErrDownloadLinkInvalid},
+		{"single-use removed", func(query url.Values) string { query.Del("once"); return "serial" }, ErrDownloadLinkInvalid},
+		{"no signature", func(query url.Values) string { query.Del("signature"); return "serial" }, ErrDownloadLinkInvalid},
+		{"signature not hex", func(query url.Values) string { query.Set("signature", "zz"); return "serial" }, ErrDownloadLinkInvalid},
+		{"no expiry", func(query url.Values) string { query.Del("expires"); return "serial" }, ErrDownloadLinkInvalid},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := signedQuery(t, "serial", true)
+			serialNumber := test.change(query)
+			if err := VerifyDownloadLink(serialNumber, query); !errors.Is(err, test.err) {
+				t.Errorf("VerifyDownloadLink = %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestVerifyDownloadLinkExpired(t *testing.T) {
+	withDownloadLinkSecret(t)
+
+	expires := time.Now().Add(-time.Second).Unix()
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("signature", downloadLinkSignature("serial", expires, false))
+	if err := VerifyDownloadLink("serial", query); !errors.Is(err, ErrDownloadLinkExpired) {
+		t.Errorf("VerifyDownloadLink = %v, want %v", err, ErrDownloadLinkExpired)
+	}
+
+	// A link signed with another secret is invalid rather than expired
+	downloadLinkSecret = []byte("other secret")
+	if err := VerifyDownloadLink("serial", query); !errors.Is(err, ErrDownloadLinkInvalid) {
+		t.Errorf("VerifyDownloadLink = %v, want %v", err, ErrDownloadLinkInvalid)
+	}
+}
+
+func TestConsumeDownloadLink(t *testing.T) {
+	withDownloadLinkSecret(t)
+
+	// Links that are not single-use are not recorded
+	db, statements := dryRunDB(t)
+	if err := ConsumeDownloadLink(db, signedQuery(t, "serial", false)); err != nil {
+		t.Fatal(err)
+	}
+	if len(*statements) != 0 {
+		t.Errorf("statements = %+v, want none", *statements)
+	}
+
+	// Single-use links are recorded by their canonical signature, whatever the case of the link
+	query := signedQuery(t, "serial", true)
+	signature := query.Get("signature")
+	query.Set("signature", strings.ToUpper(signature))
+	// Nothing is inserted in a dry run, so the link reads as used
+	if err := ConsumeDownloadLink(db, query); !errors.Is(err, ErrDownloadLinkUsed) {
+		t.Errorf("ConsumeDownloadLink = %v, want %v", err, ErrDownloadLinkUsed)
+	}
+
+	var recorded []interface{}
+	for _, statement := range *statements {
+		if strings.HasPrefix(statement.SQL, `INSERT INTO "used_download_links"`) {
+			recorded = statement.Vars
+		}
+	}
+	if len(recorded) == 0 || recorded[0] != signature {
+		t.Errorf("recorded %v, want the signature %s", recorded, signature)
+	}
+
+	query.Set("signature", "zz")
+	if err := ConsumeDownloadLink(db, query); !errors.Is(err, ErrDownloadLinkInvalid) {
+		t.Errorf("ConsumeDownloadLink = %v, want %v", err, ErrDownloadLinkInvalid)
+	}
+}
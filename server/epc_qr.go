@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	EPCVersion1 = "001" // Version 001 of the EPC QR code, the BIC is required
+	EPCVersion2 = "002" // Version 002 of the EPC QR code, the BIC is optional inside the EEA
+
+	EPCCharacterSetUTF8     = 1 // Payload encoded in UTF-8
+	EPCCharacterSetISO88591 = 2 // Payload encoded in ISO 8859-1
+
+	epcMaxPayloadBytes = 331         // epcMaxPayloadBytes is the maximum size of the encoded payload
+	epcMaxAmountCents  = 99999999999 // epcMaxAmountCents is the maximum amount, 999999999.99 EUR
+)
+
+// epcVersion and epcCharacterSet are the version and the character set of the payment QR codes of the passes
+var (
+	epcVersion      = EPCVersion1
+	epcCharacterSet = EPCCharacterSetISO88591
+)
+
+var (
+	purposePattern = regexp.MustCompile(`^[A-Z0-9]{4}$`)
+	rfPattern      = regexp.MustCompile(`^RF[0-9]{2}[A-Z0-9]{1,21}$`)
+)
+
+// EPCPayment is a SEPA credit transfer encoded in a QR code as defined by the EPC069-12 guidelines
+type EPCPayment struct {
+	Version        string // Version is EPCVersion1 or EPCVersion2
+	CharacterSet   int    // CharacterSet is EPCCharacterSetUTF8 or EPCCharacterSetISO88591
+	BIC            string // BIC of the beneficiary bank, optional in version 002
+	Name           string // Name of the beneficiary, up to 70 characters
+	IBAN           string // IBAN of the beneficiary account
+	AmountCents    int64  // AmountCents is the amount in euro cents, 0 leaves the amount to the payer
+	Purpose        string // Purpose is the optional 4 character purpose code of the transfer
+	Reference      string // Reference is the optional ISO 11649 structured creditor reference (RF...)
+	RemittanceText string // RemittanceText is the optional unstructured remittance information, not allowed with a Reference
+	Information    string // Information is the optional beneficiary to originator information, up to 70 characters
+}
+
+// NewPassPayment returns the payment to the company of the pass in the configured version and character set.
+// A payment reference in the ISO 11649 format is sent as a structured reference, any other as remittance text.
+// Payments with texts that ISO 8859-1 can't encode, like company names with č or ł, are encoded in UTF-8
+func NewPassPayment(pass Pass) EPCPayment {
+	payment := EPCPayment{
+		Version:      epcVersion,
+		CharacterSet: epcCharacterSet,
+		BIC:          pass.BIC,
+		Name:         pass.CompanyName,
+		IBAN:         pass.IBAN,
+		AmountCents:  pass.PaymentAmount,
+	}
+
+	reference := strings.TrimSpace(pass.PaymentReference)
+	if compact := strings.ToUpper(strings.ReplaceAll(reference, " ", "")); isCreditorReference(compact) {
+		payment.Reference = compact
+	} else {
+		payment.RemittanceText = reference
+	}
+
+	if payment.CharacterSet == EPCCharacterSetISO88591 && !isLatin1(payment.Name+payment.RemittanceText) {
+		payment.CharacterSet = EPCCharacterSetUTF8
+	}
+
+	return payment
+}
+
+// MessageEncoding returns the encoding Wallet has to use for the payload in the barcode of the pass
+func (p EPCPayment) MessageEncoding() string {
+	if p.CharacterSet == EPCCharacterSetUTF8 {
+		return "utf-8"
+	}
+	return "iso-8859-1"
+}
+
+// Encode validates the payment and returns the payload of its QR code
+func (p EPCPayment) Encode() (string, error) {
+	if p.Version != EPCVersion1 && p.Version != EPCVersion2 {
+		return "", fmt.Errorf("unsupported EPC QR version %q", p.Version)
+	}
+	if p.CharacterSet != EPCCharacterSetUTF8 && p.CharacterSet != EPCCharacterSetISO88591 {
+		return "", fmt.Errorf("unsupported EPC QR character set %d", p.CharacterSet)
+	}
+
+	bic := strings.ToUpper(strings.TrimSpace(p.BIC))
+	if bic == "" && p.Version == EPCVersion1 {
+		return "", errors.New("BIC is required in EPC QR version 001")
+	}
+	if bic != "" && !bicPattern.MatchString(bic) {
+		return "", fmt.Errorf("invalid BIC %q", p.BIC)
+	}
+
+	iban := strings.ToUpper(strings.ReplaceAll(p.IBAN, " ", ""))
+	if iban == "" || len(iban) > 34 {
+		return "", fmt.Errorf("invalid IBAN %q", p.IBAN)
+	}
+
+	amount := ""
+	if p.AmountCents < 0 || p.AmountCents > epcMaxAmountCents {
+		return "", fmt.Errorf("amount must be between 0.01 and 999999999.99 EUR, got %d cents", p.AmountCents)
+	}
+	if p.AmountCents > 0 {
+		amount = fmt.Sprintf("EUR%d.%02d", p.AmountCents/100, p.AmountCents%100)
+	}
+
+	if p.Purpose != "" && !purposePattern.MatchString(p.Purpose) {
+		return "", fmt.Errorf("invalid purpose code %q", p.Purpose)
+	}
+	if p.Reference != "" && p.RemittanceText != "" {
+		return "", errors.New("a structured reference and a remittance text can't be used together")
+	}
+	if p.Reference != "" && !isCreditorReference(p.Reference) {
+		return "", fmt.Errorf("invalid creditor reference %q", p.Reference)
+	}
+
+	texts := []struct {
+		name      string
+		value     string
+		maxLength int
+		required  bool
+	}{
+		{"beneficiary name", p.Name, 70, true},
+		{"remittance text", p.RemittanceText, 140, false},
+		{"information", p.Information, 70, false},
+	}
+	for _, text := range texts {
+		if text.required && strings.TrimSpace(text.value) == "" {
+			return "", fmt.Errorf("%s is required", text.name)
+		}
+		if err := p.validateText(text.name, text.value, text.maxLength); err != nil {
+			return "", err
+		}
+	}
+
+	payload := strings.Join([]string{
+		"BCD",
+		p.Version,
+		strconv.Itoa(p.CharacterSet),
+		"SCT",
+		bic,
+		strings.TrimSpace(p.Name),
+		iban,
+		amount,
+		p.Purpose,
+		p.Reference,
+		strings.TrimSpace(p.RemittanceText),
+		strings.TrimSpace(p.Information),
+	}, "\n")
+	// The optional elements at the end can be left out with their line breaks
+	payload = strings.TrimRight(payload, "\n")
+
+	size := len(payload)
+	if p.CharacterSet == EPCCharacterSetISO88591 {
+		size = utf8.RuneCountInString(payload)
+	}
+	if size > epcMaxPayloadBytes {
+		return "", fmt.Errorf("EPC QR payload is %d bytes, the maximum is %d", size, epcMaxPayloadBytes)
+	}
+
+	return payload, nil
+}
+
+// validateText checks the text fits in the field and can be encoded in the character set of the payment
+func (p EPCPayment) validateText(name, value string, maxLength int) error {
+	value = strings.TrimSpace(value)
+	if utf8.RuneCountInString(value) > maxLength {
+		return fmt.Errorf("%s is longer than %d characters", name, maxLength)
+	}
+	if !utf8.ValidString(value) {
+		return fmt.Errorf("%s is not valid UTF-8", name)
+	}
+	for _, r := range value {
+		if r == '\n' || r == '\r' {
+			return fmt.Errorf("%s can't contain line breaks", name)
+		}
+		if p.CharacterSet == EPCCharacterSetISO88591 && r > 0xFF {
+			return fmt.Errorf("%s contains %q, which can't be encoded in ISO 8859-1", name, r)
+		}
+	}
+	return nil
+}
+
+// isLatin1 reports whether every character of the text can be encoded in ISO 8859-1
+func isLatin1(text string) bool {
+	for _, r := range text {
+		if r > 0xFF {
+			return false
+		}
+	}
+	return true
+}
+
+// isCreditorReference reports whether the reference is a valid ISO 11649 creditor reference
+func isCreditorReference(reference string) bool {
+	if !rfPattern.MatchString(reference) {
+		return false
+	}
+
+	// The check digits are valid like the ones of IBANs, when the reference with its first 4 characters moved to the end is 1 modulo 97
+	return mod97(reference[4:]+reference[:4]) == 1
+}
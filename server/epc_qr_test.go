@@ -0,0 +1,202 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func testPayment() EPCPayment {
+	return EPCPayment{
+		Version:      EPCVersion1,
+		CharacterSet: EPCCharacterSetISO88591,
+		BIC:          "COBADEFFXXX",
+		Name:         "Finom",
+		IBAN:         "DE89370400440532013000",
+		AmountCents:  1250,
+	}
+}
+
+func TestEPCPaymentEncode(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(p *EPCPayment)
+		payload string
+	}{
+		{
+			name:    "minimal",
+			change:  func(p *EPCPayment) {},
+			payload: "BCD\n001\n2\nSCT\nCOBADEFFXXX\nFinom\nDE89370400440532013000\nEUR12.50",
+		},
+		{
+			name:    "no amount",
+			change:  func(p *EPCPayment) { p.AmountCents = 0 },
+			payload: "BCD\n001\n2\nSCT\nCOBADEFFXXX\nFinom\nDE89370400440532013000",
+		},
+		{
+			name:    "maximum amount",
+			change:  func(p *EPCPayment) { p.AmountCents = epcMaxAmountCents },
+			payload: "BCD\n001\n2\nSCT\nCOBADEFFXXX\nFinom\nDE89370400440532013000\nEUR999999999.99",
+		},
+		{
+			name:    "structured reference",
+			change:  func(p *EPCPayment) { p.Reference = "RF18539007547034" },
+			payload: "BCD\n001\n2\nSCT\nCOBADEFFXXX\nFinom\nDE89370400440532013000\nEUR12.50\n\nRF18539007547034",
+		},
+		{
+			name: "remittance text and information",
+			change: func(p *EPCPayment) {
+				p.Purpose = "GDDS"
+				p.RemittanceText = "Invoice 42"
+				p.Information = "Thank you"
+			},
+			payload: "BCD\n001\n2\nSCT\nCOBADEFFXXX\nFinom\nDE89370400440532013000\nEUR12.50\nGDDS\n\nInvoice 42\nThank you",
+		},
+		{
+			name:    "version 002 without BIC",
+			change:  func(p *EPCPayment) { p.Version = EPCVersion2; p.BIC = "" },
+			payload: "BCD\n002\n2\nSCT\n\nFinom\nDE89370400440532013000\nEUR12.50",
+		},
+		{
+			name:    "UTF-8",
+			change:  func(p *EPCPayment) { p.CharacterSet = EPCCharacterSetUTF8; p.Name = "Žalgiris" },
+			payload: "BCD\n001\n1\nSCT\nCOBADEFFXXX\nŽalgiris\nDE89370400440532013000\nEUR12.50",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payment := testPayment()
+			test.change(&payment)
+			payload, err := payment.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if payload != test.payload {
+				t.Errorf("payload = %q, want %q", payload, test.payload)
+			}
+		})
+	}
+}
+
+func TestEPCPaymentEncodeErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(p *EPCPayment)
+	}{
+		{"unknown version", func(p *EPCPayment) { p.Version = "003" }},
+		{"unknown character set", func(p *EPCPayment) { p.CharacterSet = 3 }},
+		{"version 001 without BIC", func(p *EPCPayment) { p.BIC = "" }},
+		{"invalid BIC", func(p *EPCPayment) { p.BIC = "COBA" }},
+		{"no IBAN", func(p *EPCPayment) { p.IBAN = "" }},
+		{"IBAN too long", func(p *EPCPayment) { p.IBAN = strings.Repeat("1", 35) }},
+		{"negative amount", func(p *EPCPayment) { p.AmountCents = -1 }},
+		{"amount too large", func(p *EPCPayment) { p.AmountCents = epcMaxAmountCents + 1 }},
+		{"invalid purpose", func(p *EPCPayment) { p.Purpose = "GDD" }},
+		{"reference and remittance text", func(p *EPCPayment) { p.Reference = "RF18539007547034"; p.RemittanceText = "Invoice" }},
+		{"invalid reference", func(p *EPCPayment) { p.Reference = "RF19539007547034" }},
+		{"no name", func(p *EPCPayment) { p.Name = " " }},
+		{"name too long", func(p *EPCPayment) { p.Name = strings.Repeat("a", 71) }},
+		{"remittance text too long", func(p *EPCPayment) { p.RemittanceText = strings.Repeat("a", 141) }},
+		{"information too long", func(p *EPCPayment) { p.Information = strings.Repeat("a", 71) }},
+		{"line break", func(p *EPCPayment) { p.Name = "Finom\nBank" }},
+		{"not ISO 8859-1", func(p *EPCPayment) { p.Name = "Žalgiris" }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payment := testPayment()
+			test.change(&payment)
+			if payload, err := payment.Encode(); err == nil {
+				t.Errorf("Encode() = %q, want an error", payload)
+			}
+		})
+	}
+}
+
+func TestEPCPaymentMaxPayload(t *testing.T) {
+	// Without the information the payload has 272 characters
+	payment := testPayment()
+	payment.Name = strings.Repeat("n", 70)
+	payment.RemittanceText = strings.Repeat("r", 140)
+
+	payment.Information = strings.Repeat("i", 59)
+	payload, err := payment.Encode()
+	if err != nil {
+		t.Fatalf("payload of %d characters: %v", len(payload), err)
+	}
+	if len(payload) != epcMaxPayloadBytes {
+		t.Fatalf("payload has %d characters, want %d", len(payload), epcMaxPayloadBytes)
+	}
+
+	payment.Information = strings.Repeat("i", 60)
+	if _, err := payment.Encode(); err == nil {
+		t.Errorf("payload of %d characters accepted", epcMaxPayloadBytes+1)
+	}
+
+	// ISO 8859-1 characters take one byte, the size is counted in characters
+	payment.Information = strings.Repeat("é", 59)
+	if _, err := payment.Encode(); err != nil {
+		t.Errorf("ISO 8859-1 payload of %d characters: %v", epcMaxPayloadBytes, err)
+	}
+
+	// UTF-8 characters can take more, the size is counted in bytes
+	payment.CharacterSet = EPCCharacterSetUTF8
+	if _, err := payment.Encode(); err == nil {
+		t.Errorf("UTF-8 payload of %d bytes accepted", epcMaxPayloadBytes+59)
+	}
+}
+
+func TestIsCreditorReference(t *testing.T) {
+	tests := []struct {
+		reference string
+		valid     bool
+	}{
+		{"RF18539007547034", true},
+		{"RF18000000000539007547034", true},
+		{"RF712348231", true},
+		{"RF19539007547034", false}, // wrong check digits
+		{"RF18 5390 0754 7034", false},
+		{"rf18539007547034", false},
+		{"RF18", false},
+		{"RF185390075470341234567890", false}, // longer than 25 characters
+		{"DE89370400440532013000", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if valid := isCreditorReference(test.reference); valid != test.valid {
+			t.Errorf("isCreditorReference(%q) = %v, want %v", test.reference, valid, test.valid)
+		}
+	}
+}
+
+func TestNewPassPayment(t *testing.T) {
+	pass := Pass{
+		CompanyName:      "Finom",
+		IBAN:             "DE89370400440532013000",
+		BIC:              "COBADEFFXXX",
+		PaymentAmount:    1250,
+		PaymentReference: " rf18 5390 0754 7034 ",
+	}
+
+	payment := NewPassPayment(pass)
+	if payment.Reference != "RF18539007547034" || payment.RemittanceText != "" {
+		t.Errorf("reference = %q, remittance text = %q, want a structured reference", payment.Reference, payment.RemittanceText)
+	}
+	if payment.CharacterSet != EPCCharacterSetISO88591 || payment.MessageEncoding() != "iso-8859-1" {
+		t.Errorf("character set = %d, want ISO 8859-1", payment.CharacterSet)
+	}
+
+	pass.PaymentReference = "Invoice 42"
+	payment = NewPassPayment(pass)
+	if payment.Reference != "" || payment.RemittanceText != "Invoice 42" {
+		t.Errorf("reference = %q, remittance text = %q, want a remittance text", payment.Reference, payment.RemittanceText)
+	}
+
+	// Company names ISO 8859-1 can't encode fall back to UTF-8, so their passes can still be rendered
+	pass.CompanyName = "Łódź Kraków Sp. z o.o."
+	payment = NewPassPayment(pass)
+	if payment.CharacterSet != EPCCharacterSetUTF8 || payment.MessageEncoding() != "utf-8" {
+		t.Errorf("character set = %d, want UTF-8", payment.CharacterSet)
+	}
+	if _, err := payment.Encode(); err != nil {
+		t.Error(err)
+	}
+}
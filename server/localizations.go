@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	LocalizationsDir    = "localizations" // Directory with the translations of the pass texts, relative to the templates directory
+	DefaultPassLanguage = "en"            // DefaultPassLanguage defines the localizable keys every other language has to translate
+
+	changeMessageKeyPrefix = "change." // changeMessageKeyPrefix starts the keys of the translated change messages, which have to contain %@
+)
+
+// localizableKeyPattern matches the dotted keys of the localizations, like label.cashback
+var localizableKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_]+(\.[A-Za-z0-9_]+)+$`)
+
+// loadLocalizations reads the translations in the localizations directory, one <language>.json, .yaml or .yml file
+// of localizable keys and their texts per language, and returns them as the <language>.lproj/pass.strings files of a pass.
+// Every language has to translate all the keys of the default language
+func loadLocalizations(dir string) (map[string][]byte, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return map[string][]byte{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	translations := make(map[string]map[string]string)
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".json" && ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+
+		language := strings.TrimSuffix(entry.Name(), ext)
+		if _, ok := translations[language]; ok {
+			return nil, fmt.Errorf("language %s is defined more than once", language)
+		}
+
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		// JSON is valid YAML, so both formats are read by the YAML decoder
+		texts := map[string]string{}
+		if err := yaml.Unmarshal(content, &texts); err != nil {
+			return nil, fmt.Errorf("error in localization %s: %v", entry.Name(), err)
+		}
+		translations[language] = texts
+	}
+
+	if len(translations) == 0 {
+		return map[string][]byte{}, nil
+	}
+
+	defaults, ok := translations[DefaultPassLanguage]
+	if !ok {
+		return nil, fmt.Errorf("default language %s not found in %s", DefaultPassLanguage, dir)
+	}
+
+	files := make(map[string][]byte, len(translations))
+	for language, texts := range translations {
+		for key := range defaults {
+			if _, ok := texts[key]; !ok {
+				return nil, fmt.Errorf("language %s has no translation of %q", language, key)
+			}
+		}
+		for key, text := range texts {
+			if strings.HasPrefix(key, changeMessageKeyPrefix) && !strings.Contains(text, "%@") {
+				return nil, fmt.Errorf("language %s: change message %q must contain %%@, the placeholder of the new value", language, key)
+			}
+		}
+		files[language+".lproj/pass.strings"] = encodePassStrings(texts)
+	}
+
+	return files, nil
+}
+
+// encodePassStrings returns the texts in the .strings format of Wallet, encoded in UTF-16 with a byte order mark
+func encodePassStrings(texts map[string]string) []byte {
+	keys := make([]string, 0, len(texts))
+	for key := range texts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var text bytes.Buffer
+	for _, key := range keys {
+		fmt.Fprintf(&text, "\"%s\" = \"%s\";\n", escapePassString(key), escapePassString(texts[key]))
+	}
+
+	units := utf16.Encode([]rune("\ufeff" + text.String()))
+	encoded := make([]byte, 2*len(units))
+	for i, unit := range units {
+		binary.LittleEndian.PutUint16(encoded[2*i:], unit)
+	}
+	return encoded
+}
+
+// escapePassString escapes the characters that can't appear in a quoted .strings value
+func escapePassString(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`).Replace(s)
+}
+
+// isLocalizableKey reports whether the text is a key of the localizations, which Wallet replaces by its translation
+func isLocalizableKey(text string) bool {
+	return localizableKeyPattern.MatchString(text)
+}
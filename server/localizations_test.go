@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"unicode/utf16"
+)
+
+// decodePassStrings decodes a UTF-16 little endian .strings file
+func decodePassStrings(t *testing.T, encoded []byte) string {
+	t.Helper()
+
+	if len(encoded)%2 != 0 {
+		t.Fatalf("%d bytes is not UTF-16", len(encoded))
+	}
+	units := make([]uint16, len(encoded)/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(encoded[2*i:])
+	}
+	return string(utf16.Decode(units))
+}
+
+func TestEncodePassStrings(t *testing.T) {
+	tests := []struct {
+		name  string
+		texts map[string]string
+		want  string
+	}{
+		{"empty", map[string]string{}, "\ufeff"},
+		{
+			"sorted keys",
+			map[string]string{"label.plan": "Plan", "label.cashback": "Cashback"},
+			"\ufeff\"label.cashback\" = \"Cashback\";\n\"label.plan\" = \"Plan\";\n",
+		},
+		{
+			"escaped characters",
+			map[string]string{"label.note": "Say \"hi\"\\\n\tbye"},
+			"\ufeff\"label.note\" = \"Say \\\"hi\\\"\\\\\\n\\tbye\";\n",
+		},
+		{
+			"characters outside the BMP",
+			map[string]string{"label.cashback": "Cashback 💶 für dich"},
+			"\ufeff\"label.cashback\" = \"Cashback 💶 für dich\";\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded := encodePassStrings(test.texts)
+			if encoded[0] != 0xff || encoded[1] != 0xfe {
+				t.Errorf("encoded starts with % x, want the little endian byte order mark", encoded[:2])
+			}
+			if got := decodePassStrings(t, encoded); got != test.want {
+				t.Errorf("encodePassStrings = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadLocalizations(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  []string // want are the names of the pass.strings files, nil if loading fails
+	}{
+		{"none", map[string]string{}, []string{}},
+		{
+			"json and yaml",
+			map[string]string{
+				"en.json":   `{"label.cashback": "Cashback"}`,
+				"de.yaml":   "label.cashback: Rückerstattung\n",
+				"notes.txt": "ignored",
+			},
+			[]string{"de.lproj/pass.strings", "en.lproj/pass.strings"},
+		},
+		{"no default language", map[string]string{"de.json": `{"label.cashback": "Rückerstattung"}`}, nil},
+		{
+			"missing translation",
+			map[string]string{
+				"en.json": `{"label.cashback": "Cashback", "label.plan": "Plan"}`,
+				"de.json": `{"label.cashback": "Rückerstattung"}`,
+			},
+			nil,
+		},
+		{"language defined twice", map[string]string{"en.json": `{}`, "en.yml": "{}"}, nil},
+		{"invalid file", map[string]string{"en.json": `{"label.cashback": ["Cashback"]}`}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range test.files {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			files, err := loadLocalizations(dir)
+			if test.want == nil {
+				if err == nil {
+					t.Errorf("loadLocalizations = %d files, want an error", len(files))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != len(test.want) {
+				t.Errorf("loadLocalizations = %d files, want %v", len(files), test.want)
+			}
+			for _, name := range test.want {
+				if _, ok := files[name]; !ok {
+					t.Errorf("%s is missing", name)
+				}
+			}
+		})
+	}
+
+	if files, err := loadLocalizations(filepath.Join(t.TempDir(), "missing")); err != nil || len(files) != 0 {
+		t.Errorf("loadLocalizations of a missing directory = %d files, %v", len(files), err)
+	}
+}
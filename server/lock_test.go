@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeyedMutexSerialisesKey(t *testing.T) {
+	m := NewKeyedMutex()
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		holders int
+		counter int
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := m.Lock("company")
+			defer unlock()
+
+			mu.Lock()
+			holders++
+			if holders > 1 {
+				t.Error("the key is held by two goroutines")
+			}
+			mu.Unlock()
+
+			counter++
+			time.Sleep(time.Millisecond)
+
+			mu.Lock()
+			holders--
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if counter != 50 {
+		t.Errorf("counter = %d, want 50", counter)
+	}
+	if len(m.locks) != 0 {
+		t.Errorf("%d locks left after unlocking every key", len(m.locks))
+	}
+}
+
+func TestKeyedMutexIndependentKeys(t *testing.T) {
+	m := NewKeyedMutex()
+	unlockA := m.Lock("a")
+
+	locked := make(chan struct{})
+	go func() {
+		unlockB := m.Lock("b")
+		unlockB()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("locking another key blocked")
+	}
+	unlockA()
+}
+
+func TestKeyedMutexWaitsForUnlock(t *testing.T) {
+	m := NewKeyedMutex()
+	unlock := m.Lock("a")
+
+	locked := make(chan struct{})
+	go func() {
+		unlock := m.Lock("a")
+		close(locked)
+		unlock()
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("the key was locked twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("the key was not locked after it was unlocked")
+	}
+}
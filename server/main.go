@@ -1,8 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -11,17 +16,21 @@ import (
 	"github.com/joho/godotenv"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"github.com/sideshow/apns2"
 	"gorm.io/gorm"
 )
 
 var db *gorm.DB
+var passSigner *PassSigner
+var pushClient *apns2.Client
 var serverURL string
 
 type pushTokenRequest struct {
 	PushToken string `json:"pushToken"`
 }
 
-func init() {
+// configure loads the configuration and connects to the database and the services the server uses
+func configure() {
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	var err error
 
@@ -56,9 +65,100 @@ func init() {
 	} else {
 		log.Info().Msg("Connected to the database successfully")
 	}
+
+	passDelivery = getEnv("PASS_DELIVERY", PassDeliveryFile)
+	if passDelivery != PassDeliveryFile && passDelivery != PassDeliveryRender {
+		log.Fatal().Str("PASS_DELIVERY", passDelivery).Msg("Unknown pass delivery mode")
+	}
+	passCacheSize, err := strconv.Atoi(getEnv("PASS_CACHE_SIZE", "1000"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid PASS_CACHE_SIZE")
+	}
+	passCache = NewPassCache(passCacheSize)
+
+	// Rendered passes are not stored, so the storage is not needed
+	if passDelivery == PassDeliveryFile {
+		passStore, err = NewBlobStore(context.Background())
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error configuring the pass storage")
+		} else {
+			log.Info().Str("STORAGE_BACKEND", getEnv("STORAGE_BACKEND", StorageLocal)).Msg("Configured the pass storage successfully")
+		}
+	}
+
+	if err := purgeDeletedPasses(db); err != nil {
+		log.Fatal().Err(err).Msg("Error removing the data of deleted passes")
+	}
+
+	if downloadLinkSecret = []byte(os.Getenv("DOWNLOAD_LINK_SECRET")); len(downloadLinkSecret) == 0 {
+		secret, err := GenerateToken()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error generating the download link secret")
+		}
+		downloadLinkSecret = []byte(secret)
+		log.Warn().Msg("DOWNLOAD_LINK_SECRET is not set, download links are valid only until the server restarts and only on this replica")
+	}
+	if downloadLinkTTL, err = time.ParseDuration(getEnv("DOWNLOAD_LINK_TTL", downloadLinkTTL.String())); err != nil {
+		log.Fatal().Err(err).Msg("Invalid DOWNLOAD_LINK_TTL")
+	}
+
+	if err := BootstrapAPIKey(db, os.Getenv("BOOTSTRAP_API_KEY")); err != nil {
+		log.Fatal().Err(err).Msg("Error storing the bootstrap API key")
+	}
+
+	passTemplates, err = NewPassTemplateStore(getEnv("PASS_TEMPLATES_DIR", PassTemplatesDir))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error loading the pass templates")
+	}
+
+	switch epcVersion = getEnv("EPC_QR_VERSION", epcVersion); epcVersion {
+	case EPCVersion1, EPCVersion2:
+	default:
+		log.Fatal().Str("EPC_QR_VERSION", epcVersion).Msg("Unknown EPC QR version")
+	}
+	switch charset := getEnv("EPC_QR_CHARSET", "iso-8859-1"); charset {
+	case "utf-8":
+		epcCharacterSet = EPCCharacterSetUTF8
+	case "iso-8859-1":
+		epcCharacterSet = EPCCharacterSetISO88591
+	default:
+		log.Fatal().Str("EPC_QR_CHARSET", charset).Msg("Unknown EPC QR character set")
+	}
+
+	passSigner, err = LoadPassSigner(CertificatesDir, os.Getenv("CERT_PASSWORD"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error loading the pass signing certificates")
+	} else {
+		log.Info().Msg("Loaded the pass signing certificates successfully")
+	}
+
+	if err := backfillAuthenticationTokens(db); err != nil {
+		log.Fatal().Err(err).Msg("Error generating authentication tokens")
+	}
+
+	pushClient, err = NewPushClient()
+	if err != nil {
+		log.Error().Err(err).Msg("Error configuring the push client, pass update notifications are disabled")
+	} else {
+		log.Info().
+			Str("APNS_AUTH", getEnv("APNS_AUTH", APNSAuthCertificate)).
+			Str("APNS_ENV", getEnv("APNS_ENV", APNSProduction)).
+			Msg("Configured the push client successfully")
+	}
 }
 
 func main() {
+	configure()
+
+	pushWorkers, err := strconv.Atoi(getEnv("PUSH_WORKERS", "2"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid PUSH_WORKERS")
+	}
+	if pushMaxAttempts, err = strconv.Atoi(getEnv("PUSH_MAX_ATTEMPTS", strconv.Itoa(pushMaxAttempts))); err != nil {
+		log.Fatal().Err(err).Msg("Invalid PUSH_MAX_ATTEMPTS")
+	}
+	StartPushWorkers(context.Background(), db, pushWorkers)
+
 	r := gin.Default()
 	// Configuring CORS
 	r.Use(cors.New(cors.Config{
@@ -74,17 +174,31 @@ func main() {
 		MaxAge: 12 * time.Hour,
 	}))
 
-	r.StaticFS("/passes", gin.Dir("./b2wData/passes", false))
+	r.GET("pass/v1/download/:fileName", downloadPass)
+
+	r.POST("pass/v1/create", AuthRequired(ScopePassesCreate), createPass)
+	r.POST("pass/v1/getPass", AuthRequired(ScopePassesRead), getPass)
+	r.POST("pass/v1/updateCashback", AuthRequired(ScopePassesUpdate), updateCashback)
+	r.POST("pass/v1/updatePlan", AuthRequired(ScopePassesUpdate), updatePlan)
+	r.POST("pass/v1/deletePass", AuthRequired(ScopeAdmin), deletePass)
+	r.POST("pass/v1/cashback/transactions", AuthRequired(ScopePassesUpdate), postCashbackTransactionRequest)
+	r.GET("pass/v1/cashback/transactions", AuthRequired(ScopePassesRead), listCashbackTransactionsRequest)
 
-	r.POST("pass/v1/create", AuthRequired(), createPass)
-	r.POST("pass/v1/getPass", AuthRequired(), getPass)
-	r.POST("pass/v1/updateCashback", AuthRequired(), updateCashback)
+	r.GET("pass/v1/admin/pushes", AuthRequired(ScopeAdmin), listPushJobs)
+	r.POST("pass/v1/admin/pushes/:id/replay", AuthRequired(ScopeAdmin), replayPushJob)
+
+	r.GET("pass/v1/admin/templates", AuthRequired(ScopeAdmin), listPassTemplatesRequest)
+
+	r.GET("pass/v1/admin/keys", AuthRequired(ScopeAdmin), listAPIKeysRequest)
+	r.POST("pass/v1/admin/keys", AuthRequired(ScopeAdmin), issueAPIKeyRequest)
+	r.POST("pass/v1/admin/keys/:id/rotate", AuthRequired(ScopeAdmin), rotateAPIKeyRequest)
+	r.DELETE("pass/v1/admin/keys/:id", AuthRequired(ScopeAdmin), revokeAPIKeyRequest)
 
 	// --- Apple Wallet Requests BEGIN --- //
-	r.POST("/pass/v1/registerDevice/v1/devices/:deviceLibraryIdentifier/registrations/:passTeamIdentifier/:serialNumber", AuthRequired(), registerDeviceRequest)
-	r.GET("/pass/v1/registerDevice/v1/devices/:deviceLibraryIdentifier/registrations/:passTeamIdentifier", checkPassUpdatesRequest)
-	r.GET("/pass/v1/registerDevice/v1/passes/:passTeamIdentifier/:serialNumber", AuthRequired(), getUpdatedPass)
-	r.DELETE("/pass/v1/registerDevice/v1/devices/:deviceLibraryIdentifier/registrations/:passTeamIdentifier/:serialNumber", deletePassRequest)
+	r.POST("/pass/v1/registerDevice/v1/devices/:deviceLibraryIdentifier/registrations/:passTypeIdentifier/:serialNumber", PassAuthRequired(), registerDeviceRequest)
+	r.GET("/pass/v1/registerDevice/v1/devices/:deviceLibraryIdentifier/registrations/:passTypeIdentifier", checkPassUpdatesRequest)
+	r.GET("/pass/v1/registerDevice/v1/passes/:passTypeIdentifier/:serialNumber", PassAuthRequired(), getUpdatedPass)
+	r.DELETE("/pass/v1/registerDevice/v1/devices/:deviceLibraryIdentifier/registrations/:passTypeIdentifier/:serialNumber", PassAuthRequired(), deletePassRequest)
 	r.POST("/pass/v1/registerDevice/v1/log", logRequest)
 	// --- Apple Wallet Requests END --- //
 
@@ -93,12 +207,21 @@ func main() {
 	}
 }
 
-func AuthRequired() gin.HandlerFunc {
+// PassAuthRequired authorises the requests of Wallet with the authentication token of the pass in the serialNumber parameter.
+// Unknown serial numbers get a 401 like wrong tokens, so they don't tell which passes exist. Deleted passes get a 404 once authenticated
+func PassAuthRequired() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		token := c.GetHeader("Authorization")
-		token = strings.TrimPrefix(token, "ApplePass ")
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "ApplePass ")
+
+		pass, err := GetPassBySerialNumber(db.Unscoped(), c.Param("serialNumber"))
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Error().Err(err).Msg("Failed to get pass for authentication")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
 
-		if token != os.Getenv("AUTH_TOKEN") {
+		if err != nil || !ok || pass.AuthenticationToken == "" ||
+			subtle.ConstantTimeCompare([]byte(token), []byte(pass.AuthenticationToken)) != 1 {
 			c.JSON(http.StatusUnauthorized, gin.H{
 				"error": "Unauthorized",
 			})
@@ -106,33 +229,47 @@ func AuthRequired() gin.HandlerFunc {
 			return
 		}
 
+		if pass.DeletedAt.Valid {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": "Pass not found",
+			})
+			c.Abort()
+			return
+		}
+
+		c.Set("pass", pass)
 		c.Next()
 	}
 }
 
 func createPass(c *gin.Context) {
 	companyID := c.PostForm("companyID")
-	cashback := c.PostForm("cashback") + "€"
+	cashbackAmount, setCashback := c.GetPostForm("cashback")
+	if !setCashback {
+		cashbackAmount = "0"
+	}
+	currency := c.DefaultPostForm("currency", DefaultCurrency)
 	log.Debug().Any("Request", c.Request.MultipartForm)
 	companyName := c.PostForm("companyName")
-	iban := c.PostForm("iban")
-	bic := c.PostForm("bic")
+	iban := NormalizeIBAN(c.PostForm("iban"))
+	bic := NormalizeBIC(c.PostForm("bic"))
 	address := c.PostForm("address")
+	plan := NormalizePlan(c.PostForm("plan"))
+	template := c.PostForm("template")
+	paymentReference := c.PostForm("paymentReference")
 
 	missingFields := []string{}
 	if companyID == "" {
 		missingFields = append(missingFields, "companyID")
 	}
-	if cashback == "" {
-		cashback = "0" + "€"
-	}
 	if companyName == "" {
 		missingFields = append(missingFields, "companyName")
 	}
 	if iban == "" {
 		missingFields = append(missingFields, "iban")
 	}
-	if bic == "" {
+	// Version 002 of the payment QR codes doesn't need the BIC
+	if bic == "" && epcVersion != EPCVersion2 {
 		missingFields = append(missingFields, "bic")
 	}
 	if address == "" {
@@ -147,15 +284,72 @@ func createPass(c *gin.Context) {
 		return
 	}
 
-	pass, err := GeneratePass(
-		db,
-		companyID,
-		cashback,
-		companyName,
-		iban,
-		bic,
-		address,
-	)
+	fieldErrors := ValidateBankDetails(iban, bic)
+	cashback, err := ParseMoney(cashbackAmount, currency)
+	if err != nil {
+		fieldErrors = append(fieldErrors, FieldError{Field: "cashback", Reason: err.Error()})
+	}
+	if len(fieldErrors) > 0 {
+		c.JSON(400, gin.H{
+			"message": "Invalid fields",
+			"errors":  fieldErrors,
+		})
+		return
+	}
+
+	if _, err := GetPassTemplate(template); template != "" && err != nil {
+		c.JSON(400, gin.H{
+			"message":   "Invalid pass template",
+			"error":     err.Error(),
+			"templates": PassTemplateNames(),
+		})
+		return
+	}
+
+	var paymentAmount int64
+	if amount := c.PostForm("paymentAmount"); amount != "" {
+		payment, err := ParseMoney(amount, "EUR")
+		if err != nil {
+			c.JSON(400, gin.H{
+				"message": "Invalid fields",
+				"errors":  []FieldError{{Field: "paymentAmount", Reason: err.Error()}},
+			})
+			return
+		}
+		paymentAmount = payment.Amount
+	}
+
+	newPass := Pass{
+		CompanyID:        companyID,
+		CompanyName:      companyName,
+		IBAN:             iban,
+		BIC:              bic,
+		Address:          address,
+		Cashback:         cashback,
+		Plan:             plan,
+		Template:         template,
+		PaymentAmount:    paymentAmount,
+		PaymentReference: paymentReference,
+	}
+	if _, err := NewPassPayment(newPass).Encode(); err != nil {
+		c.JSON(400, gin.H{
+			"message": "Invalid payment details",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	pass, job, err := GeneratePass(db, newPass, setCashback)
+	if errors.Is(err, ErrPassVersionConflict) {
+		respondVersionConflict(c, companyID)
+		return
+	}
+	if errors.Is(err, ErrCashbackCurrencyMismatch) {
+		c.JSON(422, gin.H{
+			"message": err.Error(),
+		})
+		return
+	}
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to create pass")
 		c.JSON(500, gin.H{
@@ -166,14 +360,18 @@ func createPass(c *gin.Context) {
 		return
 	}
 
-	pkpassFilePath := os.Getenv("WEB_SERVICE_URL") + "/passes/" + pass.ID.String() + ".pkpass"
-	log.Debug().Msgf("Pass was created successfully!\nLink: %s\n", pkpassFilePath)
+	link := SignDownloadLink(pass.ID.String(), c.PostForm("singleUse") == "true")
+	log.Debug().Str("PassID", pass.ID.String()).Msg("Pass was created successfully")
 
 	c.JSON(200, gin.H{
 		"message":   "Pass was created successfully",
-		"link":      pkpassFilePath,
+		"link":      link.URL,
+		"expiresAt": link.ExpiresAt,
+		"singleUse": link.SingleUse,
 		"companyID": pass.CompanyID,
 		"passID":    pass.ID,
+		"version":   pass.Version,
+		"pushJobID": job.ID,
 	})
 }
 
@@ -198,24 +396,29 @@ func getPass(c *gin.Context) {
 		return
 	}
 
+	link := SignDownloadLink(pass.ID.String(), c.PostForm("singleUse") == "true")
+
 	c.JSON(200, gin.H{
 		"message":   "Pass was retrieved successfully",
-		"link":      os.Getenv("WEB_SERVICE_URL") + "/passes/" + pass.ID.String() + ".pkpass",
+		"link":      link.URL,
+		"expiresAt": link.ExpiresAt,
+		"singleUse": link.SingleUse,
 		"companyID": companyID,
 		"passID":    pass.ID,
+		"version":   pass.Version,
 	})
 
 }
 
 func updateCashback(c *gin.Context) {
 	companyID := c.PostForm("companyID")
-	cashback := c.PostForm("cashback")
+	cashbackAmount := c.PostForm("cashback")
 
 	missingFields := []string{}
 	if companyID == "" {
 		missingFields = append(missingFields, "companyID")
 	}
-	if cashback == "" {
+	if cashbackAmount == "" {
 		missingFields = append(missingFields, "cashback")
 	}
 
@@ -225,47 +428,299 @@ func updateCashback(c *gin.Context) {
 			"fields":  missingFields,
 		})
 		return
-	} else {
-		cashback += "€"
 	}
 
-	pass, err := UpdatePassByCompanyID(db, companyID, cashback)
+	fieldErrors := []FieldError{}
+	cashback, err := ParseMoney(cashbackAmount, c.DefaultPostForm("currency", DefaultCurrency))
+	if err != nil {
+		fieldErrors = append(fieldErrors, FieldError{Field: "cashback", Reason: err.Error()})
+	}
+	version, err := formVersion(c)
 	if err != nil {
+		fieldErrors = append(fieldErrors, FieldError{Field: "version", Reason: err.Error()})
+	}
+	if len(fieldErrors) > 0 {
+		c.JSON(400, gin.H{
+			"message": "Invalid fields",
+			"errors":  fieldErrors,
+		})
+		return
+	}
+
+	pass, job, err := UpdatePassCashback(db, companyID, cashback, version)
+	if errors.Is(err, ErrPassVersionConflict) {
+		respondVersionConflict(c, companyID)
+		return
+	}
+	if errors.Is(err, ErrCashbackCurrencyMismatch) {
+		c.JSON(422, gin.H{
+			"message": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to update cashback")
 		c.JSON(500, gin.H{
-			"message":   "Failed to get pass",
+			"message":   "Failed to update cashback",
 			"error":     err.Error(),
 			"companyID": companyID,
 		})
 		return
 	}
 
-	// TODO: Add generating updated file
-	pass, err = GeneratePass(
-		db,
-		pass.CompanyID,
-		pass.Cashback,
-		pass.CompanyName,
-		pass.IBAN,
-		pass.BIC,
-		pass.Address,
-	)
+	link := SignDownloadLink(pass.ID.String(), c.PostForm("singleUse") == "true")
+
+	c.JSON(200, gin.H{
+		"message":   "Cashback was updated successfully",
+		"link":      link.URL,
+		"expiresAt": link.ExpiresAt,
+		"singleUse": link.SingleUse,
+		"companyID": companyID,
+		"version":   pass.Version,
+		"pushJobID": job.ID,
+	})
+}
+
+func updatePlan(c *gin.Context) {
+	companyID := c.PostForm("companyID")
+	plan := NormalizePlan(c.PostForm("plan"))
+
+	missingFields := []string{}
+	if companyID == "" {
+		missingFields = append(missingFields, "companyID")
+	}
+	if plan == "" {
+		missingFields = append(missingFields, "plan")
+	}
+
+	if len(missingFields) > 0 {
+		c.JSON(400, gin.H{
+			"message": "Missing required fields during the update of plan",
+			"fields":  missingFields,
+		})
+		return
+	}
+
+	version, err := formVersion(c)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to generate new pass")
+		c.JSON(400, gin.H{
+			"message": "Invalid fields",
+			"errors":  []FieldError{{Field: "version", Reason: err.Error()}},
+		})
+		return
 	}
 
-	SendNotificationPushAboutUpdate()
+	pass, job, err := UpdatePassPlan(db, companyID, plan, version)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{
+			"message":   "Pass not found",
+			"companyID": companyID,
+		})
+		return
+	}
+	if errors.Is(err, ErrPassVersionConflict) {
+		respondVersionConflict(c, companyID)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to update plan")
+		c.JSON(500, gin.H{
+			"message":   "Failed to update plan",
+			"error":     err.Error(),
+			"companyID": companyID,
+		})
+		return
+	}
+
+	link := SignDownloadLink(pass.ID.String(), c.PostForm("singleUse") == "true")
 
 	c.JSON(200, gin.H{
-		"message":   "Cashback was updated successfully",
-		"link":      os.Getenv("WEB_SERVICE_URL") + "/passes/" + pass.ID.String() + ".pkpass",
+		"message":   "Plan was updated successfully",
+		"link":      link.URL,
+		"expiresAt": link.ExpiresAt,
+		"singleUse": link.SingleUse,
 		"companyID": companyID,
+		"plan":      pass.Plan,
+		"version":   pass.Version,
+		"pushJobID": job.ID,
 	})
 }
 
+func deletePass(c *gin.Context) {
+	companyID := c.PostForm("companyID")
+	if companyID == "" {
+		c.JSON(400, gin.H{
+			"message": "Missing required fields",
+			"fields":  []string{"companyID"},
+		})
+		return
+	}
+
+	pass, err := DeletePass(db, companyID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{
+			"message":   "Pass not found",
+			"companyID": companyID,
+		})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to delete pass")
+		c.JSON(500, gin.H{
+			"message":   "Failed to delete pass",
+			"error":     err.Error(),
+			"companyID": companyID,
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"message":   "Pass was deleted successfully",
+		"companyID": companyID,
+		"passID":    pass.ID,
+	})
+}
+
+// respondVersionConflict answers a change of the company's pass that failed with ErrPassVersionConflict
+func respondVersionConflict(c *gin.Context, companyID string) {
+	c.JSON(409, gin.H{
+		"message":   ErrPassVersionConflict.Error(),
+		"companyID": companyID,
+	})
+}
+
+// formVersion returns the version form field, the version of the pass the client read and based its update on.
+// It returns 0 when the field is not sent, so the update applies to any version
+func formVersion(c *gin.Context) (int64, error) {
+	value := c.PostForm("version")
+	if value == "" {
+		return 0, nil
+	}
+
+	version, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || version <= 0 {
+		return 0, errors.New("version must be a positive integer")
+	}
+	return version, nil
+}
+
+func listPushJobs(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		c.JSON(400, gin.H{
+			"message": "Invalid limit",
+		})
+		return
+	}
+
+	jobs, err := GetPushJobs(db, c.Query("status"), limit)
+	if err != nil {
+		c.JSON(500, gin.H{
+			"message": "Failed to get push jobs",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"message": "Push jobs were retrieved successfully",
+		"jobs":    jobs,
+	})
+}
+
+func replayPushJob(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"message": "Invalid push job ID",
+		})
+		return
+	}
+
+	job, err := ReplayPushJob(db, uint(id))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{
+			"message": "Push job not found",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{
+			"message": "Failed to replay push job",
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"message": "Push job was queued for replay",
+		"job":     job,
+	})
+}
+
+func downloadPass(c *gin.Context) {
+	serialNumber, ok := strings.CutSuffix(c.Param("fileName"), ".pkpass")
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	err := VerifyDownloadLink(serialNumber, c.Request.URL.Query())
+	switch {
+	case errors.Is(err, ErrDownloadLinkInvalid):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, ErrDownloadLinkExpired):
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		log.Error().Err(err).Msg("Failed to verify download link")
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	pass, err := GetPassBySerialNumber(db, serialNumber)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get pass for download")
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	pkpassContent, err := LoadPKPass(c.Request.Context(), pass)
+	if errors.Is(err, ErrBlobNotFound) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error().Msgf("Failed to load .pkpass file: %v", err)
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	// Single-use links are consumed only when the pass can be delivered
+	err = ConsumeDownloadLink(db, c.Request.URL.Query())
+	if errors.Is(err, ErrDownloadLinkUsed) {
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to consume download link")
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.Data(http.StatusOK, "application/vnd.apple.pkpass", pkpassContent)
+}
+
 // --- Apple Wallet Requests BEGIN --- //
 
 func registerDeviceRequest(c *gin.Context) {
 	deviceLibraryIdentifier := c.Param("deviceLibraryIdentifier")
+	passTypeIdentifier := c.Param("passTypeIdentifier")
 	serialNumber := c.Param("serialNumber")
 
 	var req pushTokenRequest
@@ -275,21 +730,23 @@ func registerDeviceRequest(c *gin.Context) {
 	}
 	pushToken := req.PushToken
 
-	deviceReg, err, exists := RegisterDevice(db, deviceLibraryIdentifier, serialNumber, pushToken)
+	created, err := RegisterDevice(db, deviceLibraryIdentifier, passTypeIdentifier, serialNumber, pushToken)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
 	log.Info().
-		Str("SerialNumber", deviceReg.SerialNumber).
-		Str("PushToken", deviceReg.PushToken).
-		Msg("Registration of the new pass")
+		Str("DeviceLibraryIdentifier", deviceLibraryIdentifier).
+		Str("SerialNumber", serialNumber).
+		Bool("Created", created).
+		Msg("Registration of the pass")
 
-	if exists {
-		c.JSON(200, gin.H{})
-	} else {
+	// 201 — Registration Successful, 200 — Serial Number Already Registered for Device
+	if created {
 		c.JSON(201, gin.H{})
+	} else {
+		c.JSON(200, gin.H{})
 	}
 }
 
@@ -300,23 +757,20 @@ func checkPassUpdatesRequest(c *gin.Context) {
 
 	previousLastUpdated := c.Query("passesUpdatedSince")
 	deviceLibraryIdentifier := c.Param("deviceLibraryIdentifier")
+	passTypeIdentifier := c.Param("passTypeIdentifier")
 
-	var (
-		serialNumbers []string
-		err           error
-	)
-
-	// Check if it is the first request from the device
-	if len(previousLastUpdated) == 0 {
-		// Get all passes for the device
-		serialNumbers, err = GetPassesByDeviceID(db, deviceLibraryIdentifier)
-	} else {
-		// Get updated passes for the device
-		serialNumbers, err = GetUpdatedPasses(db, deviceLibraryIdentifier, previousLastUpdated)
+	serialNumbers, lastUpdated, err := GetUpdatedPasses(db, deviceLibraryIdentifier, passTypeIdentifier, previousLastUpdated)
+	if err != nil && previousLastUpdated != "" {
+		// The tag is not one of ours, so send all the passes of the device and a fresh tag
+		log.Warn().
+			Err(err).
+			Str("DeviceLibraryIdentifier", deviceLibraryIdentifier).
+			Msg("Invalid update tag")
+		serialNumbers, lastUpdated, err = GetUpdatedPasses(db, deviceLibraryIdentifier, passTypeIdentifier, "")
 	}
-
 	if err != nil {
-		log.Error().Err(err)
+		log.Error().Err(err).Msg("Failed to get updated passes")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
@@ -326,7 +780,7 @@ func checkPassUpdatesRequest(c *gin.Context) {
 			Msg("No matching passes found for the device")
 
 		// 204 — No Matching Passes
-		c.JSON(204, gin.H{})
+		c.Status(http.StatusNoContent)
 		return
 	}
 
@@ -334,8 +788,6 @@ func checkPassUpdatesRequest(c *gin.Context) {
 		Str("DeviceLibraryIdentifier", deviceLibraryIdentifier).
 		Msg("Matching passes found for the device")
 
-	// Update the lastUpdated timestamp of the device
-	lastUpdated := time.Now().UTC().Format(time.RFC3339)
 	response := gin.H{
 		"lastUpdated":   lastUpdated,
 		"serialNumbers": serialNumbers,
@@ -343,37 +795,46 @@ func checkPassUpdatesRequest(c *gin.Context) {
 	log.Debug().
 		Interface("Response", response).
 		Str("DeviceLibraryIdentifier", deviceLibraryIdentifier).
-		Str("LastUpdated", lastUpdated)
+		Str("LastUpdated", lastUpdated).
+		Msg("Updated passes")
 
 	// 200 — Matching Passes Found
 	c.JSON(200, response)
 }
 
 func getUpdatedPass(c *gin.Context) {
-	serialNumber := c.Param("serialNumber")
+	pass := c.MustGet("pass").(Pass)
+	serialNumber := pass.ID.String()
 	log.Info().
 		Str("SerialNumber", serialNumber).
 		Msg("Request for updated pass")
 
-	filePath := "./b2wData/passes/" + serialNumber + ".pkpass"
-	// Read the .pkpass file content
-	pkpassContent, err := os.ReadFile(filePath)
+	pkpassContent, err := LoadPKPass(c.Request.Context(), pass)
+	if errors.Is(err, ErrBlobNotFound) {
+		log.Error().Str("SerialNumber", serialNumber).Msg("The .pkpass file of the pass doesn't exist")
+		c.Status(http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		log.Error().Msgf("Failed to read .pkpass file: %v", err)
+		log.Error().Msgf("Failed to load .pkpass file: %v", err)
 		c.Status(http.StatusInternalServerError)
 		return
 	}
-	// Set the correct Content-Type headers
-	lastModifiedTime := time.Now().UTC().Format(http.TimeFormat)
-	c.Header("Last-Modified", lastModifiedTime)
+
+	// ServeContent answers If-None-Match and If-Modified-Since with 304 Not Modified
+	// when the pass didn't change since the version the device has. The ETag is the version of the pass and not
+	// a hash of the file, because the signing time makes every rendering of the same version different
 	c.Header("Content-Type", "application/vnd.apple.pkpass")
-	// Send the .pkpass file content as the response
-	c.Writer.Write(pkpassContent)
+	c.Header("ETag", `"`+passVersion(pass)+`"`)
+	http.ServeContent(c.Writer, c.Request, serialNumber+".pkpass", passLastModified(pass), bytes.NewReader(pkpassContent))
 }
 
 func deletePassRequest(c *gin.Context) {
+	deviceLibraryIdentifier := c.Param("deviceLibraryIdentifier")
+	passTypeIdentifier := c.Param("passTypeIdentifier")
 	serialNumber := c.Param("serialNumber")
-	err := DeletePassOnDevice(db, serialNumber)
+
+	err := UnregisterDevice(db, deviceLibraryIdentifier, passTypeIdentifier, serialNumber)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -382,6 +843,7 @@ func deletePassRequest(c *gin.Context) {
 	}
 
 	log.Info().
+		Str("DeviceLibraryIdentifier", deviceLibraryIdentifier).
 		Str("SerialNumber", serialNumber).
 		Msg("Pass was unregistered")
 }
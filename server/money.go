@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// DefaultCurrency is the currency of the amounts sent without one
+const DefaultCurrency = "EUR"
+
+// currencyExponents is the number of digits after the decimal separator of the minor unit of the supported ISO 4217 currencies
+var currencyExponents = map[string]int{
+	"BGN": 2, "CHF": 2, "CZK": 2, "DKK": 2, "EUR": 2, "GBP": 2, "HUF": 2, "ISK": 0, "JPY": 0,
+	"NOK": 2, "PLN": 2, "RON": 2, "SEK": 2, "USD": 2,
+}
+
+// Money is an amount in the minor unit of its ISO 4217 currency, like cents for euros
+type Money struct {
+	Amount   int64  `json:"amount"`   // Amount is the number of minor units
+	Currency string `json:"currency"` // Currency is the ISO 4217 code of the currency
+}
+
+// ParseMoney parses a non-negative decimal amount, like 12, 12.5 or 12,50, in the currency.
+// The amount can't have more decimals than the minor unit of the currency
+func ParseMoney(amount, currency string) (Money, error) {
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	exponent, ok := currencyExponents[currency]
+	if !ok {
+		return Money{}, fmt.Errorf("unsupported currency %q", currency)
+	}
+
+	normalized := strings.ReplaceAll(strings.TrimSpace(amount), ",", ".")
+	units, decimals, hasDecimals := strings.Cut(normalized, ".")
+	if units == "" || (hasDecimals && (len(decimals) == 0 || len(decimals) > exponent)) {
+		return Money{}, fmt.Errorf("invalid amount %q, expected a number with up to %d decimals", amount, exponent)
+	}
+	decimals += strings.Repeat("0", exponent-len(decimals))
+
+	value, err := strconv.ParseUint(units+decimals, 10, 63)
+	if err != nil {
+		return Money{}, fmt.Errorf("invalid amount %q, expected a number with up to %d decimals", amount, exponent)
+	}
+
+	return Money{Amount: int64(value), Currency: currency}, nil
+}
+
+// Decimal returns the amount in the major unit of the currency, like 12.50
+func (m Money) Decimal() string {
+	exponent := currencyExponents[m.Currency]
+	if exponent == 0 {
+		return strconv.FormatInt(m.Amount, 10)
+	}
+
+	divisor := int64(math.Pow10(exponent))
+	return fmt.Sprintf("%d.%0*d", m.Amount/divisor, exponent, m.Amount%divisor)
+}
+
+// Number returns the amount in the major unit of the currency as a JSON number
+func (m Money) Number() json.Number {
+	return json.Number(m.Decimal())
+}
+
+// String returns the amount with its currency code, like 12.50 EUR
+func (m Money) String() string {
+	return m.Decimal() + " " + m.Currency
+}
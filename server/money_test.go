@@ -0,0 +1,78 @@
+package main
+
+import "testing"
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		amount, currency string
+		want             Money
+		valid            bool
+	}{
+		{"12", "EUR", Money{1200, "EUR"}, true},
+		{"12.5", "EUR", Money{1250, "EUR"}, true},
+		{"12,50", "EUR", Money{1250, "EUR"}, true},
+		{"0", "EUR", Money{0, "EUR"}, true},
+		{"0.01", "EUR", Money{1, "EUR"}, true},
+		{" 7.10 ", " eur ", Money{710, "EUR"}, true},
+		{"100", "JPY", Money{100, "JPY"}, true},
+		{"92233720368547758.07", "EUR", Money{9223372036854775807, "EUR"}, true},
+		{"92233720368547758.08", "EUR", Money{}, false}, // overflows int64
+		{"100.5", "JPY", Money{}, false},                // JPY has no minor unit
+		{"12.505", "EUR", Money{}, false},               // more decimals than cents
+		{"12.", "EUR", Money{}, false},
+		{".5", "EUR", Money{}, false},
+		{"-1", "EUR", Money{}, false},
+		{"+1", "EUR", Money{}, false},
+		{"1 000", "EUR", Money{}, false},
+		{"1.2.3", "EUR", Money{}, false},
+		{"abc", "EUR", Money{}, false},
+		{"", "EUR", Money{}, false},
+		{"12", "XYZ", Money{}, false},
+		{"12", "", Money{}, false},
+	}
+	for _, test := range tests {
+		got, err := ParseMoney(test.amount, test.currency)
+		if (err == nil) != test.valid {
+			t.Errorf("ParseMoney(%q, %q) error = %v, want valid %v", test.amount, test.currency, err, test.valid)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParseMoney(%q, %q) = %+v, want %+v", test.amount, test.currency, got, test.want)
+		}
+	}
+}
+
+func TestMoneyFormat(t *testing.T) {
+	tests := []struct {
+		money   Money
+		decimal string
+		str     string
+	}{
+		{Money{1250, "EUR"}, "12.50", "12.50 EUR"},
+		{Money{5, "EUR"}, "0.05", "0.05 EUR"},
+		{Money{0, "EUR"}, "0.00", "0.00 EUR"},
+		{Money{100, "JPY"}, "100", "100 JPY"},
+		{Money{123456, "ISK"}, "123456", "123456 ISK"},
+	}
+	for _, test := range tests {
+		if decimal := test.money.Decimal(); decimal != test.decimal {
+			t.Errorf("%+v Decimal() = %q, want %q", test.money, decimal, test.decimal)
+		}
+		if number := test.money.Number(); number.String() != test.decimal {
+			t.Errorf("%+v Number() = %q, want %q", test.money, number, test.decimal)
+		}
+		if str := test.money.String(); str != test.str {
+			t.Errorf("%+v String() = %q, want %q", test.money, str, test.str)
+		}
+	}
+}
+
+func TestParseMoneyRoundTrip(t *testing.T) {
+	for currency := range currencyExponents {
+		money := Money{Amount: 123456, Currency: currency}
+		parsed, err := ParseMoney(money.Decimal(), currency)
+		if err != nil || parsed != money {
+			t.Errorf("ParseMoney(%q, %q) = %+v, %v, want %+v", money.Decimal(), currency, parsed, err, money)
+		}
+	}
+}
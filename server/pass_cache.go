@@ -0,0 +1,68 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// PassCache keeps the most recently used rendered pkpass files in memory, keyed by serial number and pass version.
+// A new version of a pass replaces the cached older one
+type PassCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List               // order holds the cached entries, most recently used first
+	entries map[string]*list.Element // entries maps serial numbers to their element in order
+}
+
+type passCacheEntry struct {
+	serialNumber string
+	version      string
+	pkpass       []byte
+}
+
+// NewPassCache returns a cache holding up to size pkpass files
+func NewPassCache(size int) *PassCache {
+	return &PassCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Get returns the cached pkpass file of the given version of the pass
+func (c *PassCache) Get(serialNumber, version string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[serialNumber]
+	if !ok || element.Value.(*passCacheEntry).version != version {
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	return element.Value.(*passCacheEntry).pkpass, true
+}
+
+// Add caches the pkpass file of the given version of the pass, evicting the least recently used file if the cache is full
+func (c *PassCache) Add(serialNumber, version string, pkpass []byte) {
+	if c.size <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &passCacheEntry{serialNumber: serialNumber, version: version, pkpass: pkpass}
+	if element, ok := c.entries[serialNumber]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[serialNumber] = c.order.PushFront(entry)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*passCacheEntry).serialNumber)
+	}
+}
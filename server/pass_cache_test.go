@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPassCacheVersions(t *testing.T) {
+	cache := NewPassCache(10)
+
+	if _, ok := cache.Get("a", "1"); ok {
+		t.Fatal("empty cache returned a file")
+	}
+
+	cache.Add("a", "1", []byte("a1"))
+	if pkpass, ok := cache.Get("a", "1"); !ok || !bytes.Equal(pkpass, []byte("a1")) {
+		t.Errorf("Get(a, 1) = %q, %v, want a1", pkpass, ok)
+	}
+	if _, ok := cache.Get("a", "2"); ok {
+		t.Error("Get(a, 2) returned the file of version 1")
+	}
+
+	// A new version replaces the cached one
+	cache.Add("a", "2", []byte("a2"))
+	if _, ok := cache.Get("a", "1"); ok {
+		t.Error("Get(a, 1) returned a file after version 2 was cached")
+	}
+	if pkpass, ok := cache.Get("a", "2"); !ok || !bytes.Equal(pkpass, []byte("a2")) {
+		t.Errorf("Get(a, 2) = %q, %v, want a2", pkpass, ok)
+	}
+	if cache.order.Len() != 1 {
+		t.Errorf("cache holds %d files, want 1", cache.order.Len())
+	}
+}
+
+func TestPassCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := NewPassCache(2)
+	cache.Add("a", "1", []byte("a"))
+	cache.Add("b", "1", []byte("b"))
+
+	// Using a makes b the least recently used file
+	if _, ok := cache.Get("a", "1"); !ok {
+		t.Fatal("Get(a, 1) missed")
+	}
+	cache.Add("c", "1", []byte("c"))
+
+	if _, ok := cache.Get("b", "1"); ok {
+		t.Error("b was not evicted")
+	}
+	for _, serialNumber := range []string{"a", "c"} {
+		if _, ok := cache.Get(serialNumber, "1"); !ok {
+			t.Errorf("%s was evicted", serialNumber)
+		}
+	}
+	if cache.order.Len() != 2 || len(cache.entries) != 2 {
+		t.Errorf("cache holds %d files and %d entries, want 2", cache.order.Len(), len(cache.entries))
+	}
+}
+
+func TestPassCacheDisabled(t *testing.T) {
+	cache := NewPassCache(0)
+	cache.Add("a", "1", []byte("a"))
+	if _, ok := cache.Get("a", "1"); ok {
+		t.Error("a cache of size 0 returned a file")
+	}
+}
@@ -1,31 +1,55 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
+	"strconv"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	"gorm.io/gorm"
 )
 
 const (
-	TemplateDir     = "./template"      // Directory with the template images
-	TempDir         = "./b2wData/tmp/"  // Directory to store the temporary pass files
-	PassesDir       = "./passes/"       // Directory to store the generated pkpass files
-	CertificatesDir = "./certificates/" // Directory with the certificates
+	PassTypeIdentifier = "pass.com.finom.bank2wallet" // Pass type of the pass signing certificate
+
+	PassesDir       = "./b2wData/passes/" // Directory to store the generated pkpass files in the local storage
+	CertificatesDir = "./certificates/"   // Directory with the certificates
+
+	PassDeliveryFile   = "file"   // Passes are rendered when they change and served from the blob storage
+	PassDeliveryRender = "render" // Passes are rendered from the database when they are requested
 )
 
+// passDelivery is the way pkpass files are delivered, PassDeliveryFile or PassDeliveryRender
+var passDelivery = PassDeliveryFile
+
+// passCache holds the rendered pkpass files in the render delivery mode
+var passCache = NewPassCache(0)
+
+// passStore stores the rendered pkpass files in the file delivery mode. It is nil in the render delivery mode
+var passStore BlobStore
+
 // Field represents a field in the pass
 type Field struct {
-	Key   string `json:"key"`
-	Label string `json:"label"`
-	Value string `json:"value"`
+	Key             string      `json:"key"`
+	Label           string      `json:"label"`
+	Value           interface{} `json:"value"`                     // Value is a string, or a number when the field has a currency code or number style
+	AttributedValue string      `json:"attributedValue,omitempty"` // AttributedValue is the value with HTML links shown instead of Value, only on the back of the pass
+	ChangeMessage   string      `json:"changeMessage,omitempty"`   // ChangeMessage is the notice shown on the lock screen when the value changes, %@ is replaced by the new value
+	TextAlignment   string      `json:"textAlignment,omitempty"`   // TextAlignment is one of the PKTextAlignment alignments
+	DateStyle       string      `json:"dateStyle,omitempty"`       // DateStyle formats the ISO 8601 date value with one of the PKDateStyle styles
+	TimeStyle       string      `json:"timeStyle,omitempty"`       // TimeStyle formats the time of the ISO 8601 date value with one of the PKDateStyle styles
+	CurrencyCode    string      `json:"currencyCode,omitempty"`    // CurrencyCode formats the numeric value as an amount in the ISO 4217 currency
+	NumberStyle     string      `json:"numberStyle,omitempty"`     // NumberStyle formats the numeric value with one of the PKNumberStyle styles
 }
 
-// Generic represents the generic type of pass
-type Generic struct {
+// PassStructure represents the fields of the pass. Every pass style uses the same structure,
+// only boarding passes also set the transit type
+type PassStructure struct {
+	TransitType     string  `json:"transitType,omitempty"`
 	HeaderFields    []Field `json:"headerFields"`
 	PrimaryFields   []Field `json:"primaryFields"`
 	SecondaryFields []Field `json:"secondaryFields"`
@@ -40,213 +64,434 @@ type Barcode struct {
 	MessageEncoding string `json:"messageEncoding"`
 }
 
-// PassData represents the data itself in the pass
+// PassData represents the data itself in the pass. Exactly one of the style fields is set
 type PassData struct {
-	FormatVersion       int     `json:"formatVersion"`
-	PassTypeIdentifier  string  `json:"passTypeIdentifier"`
-	SerialNumber        string  `json:"serialNumber"`
-	WebServiceURL       string  `json:"webServiceURL"`
-	AuthenticationToken string  `json:"authenticationToken"`
-	TeamIdentifier      string  `json:"teamIdentifier"`
-	OrganizationName    string  `json:"organizationName"`
-	Description         string  `json:"description"`
-	LogoText            string  `json:"logoText"`
-	BackgroundColor     string  `json:"backgroundColor"`
-	ForegroundColor     string  `json:"foregroundColor"`
-	LabelColor          string  `json:"labelColor"`
-	Generic             Generic `json:"generic"`
-	Barcode             Barcode `json:"barcode"`
-}
-
-// CreatePassStructure creates the structure of the pass card with the given data
-func CreatePassStructure(pass Pass) PassData {
+	FormatVersion       int            `json:"formatVersion"`
+	PassTypeIdentifier  string         `json:"passTypeIdentifier"`
+	SerialNumber        string         `json:"serialNumber"`
+	WebServiceURL       string         `json:"webServiceURL"`
+	AuthenticationToken string         `json:"authenticationToken"`
+	TeamIdentifier      string         `json:"teamIdentifier"`
+	OrganizationName    string         `json:"organizationName"`
+	Description         string         `json:"description"`
+	LogoText            string         `json:"logoText"`
+	BackgroundColor     string         `json:"backgroundColor"`
+	ForegroundColor     string         `json:"foregroundColor"`
+	LabelColor          string         `json:"labelColor"`
+	Generic             *PassStructure `json:"generic,omitempty"`
+	StoreCard           *PassStructure `json:"storeCard,omitempty"`
+	Coupon              *PassStructure `json:"coupon,omitempty"`
+	EventTicket         *PassStructure `json:"eventTicket,omitempty"`
+	BoardingPass        *PassStructure `json:"boardingPass,omitempty"`
+	Barcode             Barcode        `json:"barcode"`
+}
 
-	serialNumber := pass.ID.String()
+// SetStructure sets the fields of the pass in the given style
+func (p *PassData) SetStructure(style string, structure PassStructure) error {
+	if style == PassStyleBoardingPass {
+		if !isTransitType(structure.TransitType) {
+			return fmt.Errorf("boarding passes require a valid transit type, got %q", structure.TransitType)
+		}
+	} else if structure.TransitType != "" {
+		return fmt.Errorf("transit type is only allowed on boarding passes, got it on %s", style)
+	}
+
+	p.Generic, p.StoreCard, p.Coupon, p.EventTicket, p.BoardingPass = nil, nil, nil, nil, nil
+	switch style {
+	case PassStyleGeneric:
+		p.Generic = &structure
+	case PassStyleStoreCard:
+		p.StoreCard = &structure
+	case PassStyleCoupon:
+		p.Coupon = &structure
+	case PassStyleEventTicket:
+		p.EventTicket = &structure
+	case PassStyleBoardingPass:
+		p.BoardingPass = &structure
+	default:
+		return fmt.Errorf("unknown pass style %q", style)
+	}
+
+	return nil
+}
+
+// CreatePassStructure creates the structure of the pass card with the given data in the design of the pass template
+func CreatePassStructure(pass Pass) (PassData, error) {
+	template, err := GetPassTemplateFor(pass)
+	if err != nil {
+		return PassData{}, err
+	}
 
-	return PassData{
+	payment := NewPassPayment(pass)
+	paymentMessage, err := payment.Encode()
+	if err != nil {
+		return PassData{}, fmt.Errorf("error encoding payment QR code: %v", err)
+	}
+
+	values := passPlaceholders(pass)
+	passData := PassData{
 		FormatVersion:       1,
-		PassTypeIdentifier:  "pass.com.finom.bank2wallet",
-		SerialNumber:        serialNumber,
+		PassTypeIdentifier:  PassTypeIdentifier,
+		SerialNumber:        pass.ID.String(),
 		WebServiceURL:       os.Getenv("WEB_SERVICE_URL") + "/pass/v1/registerDevice",
-		AuthenticationToken: os.Getenv("AUTH_TOKEN"),
-		TeamIdentifier:      "35XPTK6L36",
-		OrganizationName:    "Finom",
-		Description:         "Your Finom Bank Details",
-		LogoText:            "Your Bank Details",
-		BackgroundColor:     "rgb(255, 76, 92)",
-		ForegroundColor:     "rgb(255, 255, 255)",
-		LabelColor:          "rgb(11, 0, 46)",
-		Generic: Generic{
-			HeaderFields: []Field{
-				{
-					Key:   "cashback",
-					Label: "CASHBACK",
-					Value: pass.Cashback,
-				},
-			},
-			PrimaryFields: []Field{
-				{
-					Key:   "company-name",
-					Value: pass.CompanyName,
-				},
-			},
-			SecondaryFields: []Field{
-				{
-					Key:   "iban",
-					Label: "IBAN",
-					Value: pass.IBAN,
-				},
-				{
-					Key:   "bic",
-					Label: "BIC",
-					Value: pass.BIC,
-				},
-			},
-			AuxiliaryFields: []Field{
-				{
-					Key:   "address",
-					Label: "ADDRESS",
-					Value: pass.Address,
-				},
-			},
-			BackFields: []Field{
-				{
-					Key:   "serialNumber",
-					Label: "Serial Number",
-					Value: serialNumber,
-				},
-				{
-					Key:   "companyID",
-					Label: "Company ID",
-					Value: pass.CompanyID,
-				},
-				{
-					Key:   "info",
-					Label: "Additional Information",
-					Value: "This pass contains your bank credentials in Finom and is valid for SEPA payments only. \nGo to https://finom.co/passes/ for more information.",
-				},
-			},
-		},
+		AuthenticationToken: pass.AuthenticationToken,
+		TeamIdentifier:      template.TeamIdentifier,
+		OrganizationName:    template.OrganizationName,
+		Description:         fillPlaceholders(template.Description, values),
+		LogoText:            fillPlaceholders(template.LogoText, values),
+		BackgroundColor:     template.BackgroundColor,
+		ForegroundColor:     template.ForegroundColor,
+		LabelColor:          template.LabelColor,
 		Barcode: Barcode{
 			Format:          "PKBarcodeFormatQR",
-			Message:         "BCD\n001\n1\nSCT\n" + pass.BIC + "\n" + pass.CompanyName + "\n" + pass.IBAN,
-			MessageEncoding: "iso-8859-1",
+			Message:         paymentMessage,
+			MessageEncoding: payment.MessageEncoding(),
 		},
 	}
-}
 
-// CreatePass generates the necessary directories and files for a pass. It returns the name of the pass file in the pkpass format
-func GeneratePass(db *gorm.DB, companyID, cashback, companyName, iban, bic, address string) (Pass, error) {
-	passDB, err := AddNewPass(db, companyID, cashback, companyName, iban, bic, address)
+	structure, err := template.Layout(pass)
 	if err != nil {
-		return Pass{}, fmt.Errorf("error adding new pass: %v", err)
+		return PassData{}, fmt.Errorf("error in pass template %s: %v", template.Name, err)
+	}
+	if err := passData.SetStructure(template.Style, structure); err != nil {
+		return PassData{}, fmt.Errorf("error in pass template %s: %v", template.Name, err)
 	}
 
-	passCard := CreatePassStructure(passDB)
-	passName := passDB.ID.String()
+	return passData, nil
+}
 
-	// Directories and files to create
-	if err := CreateDir(TempDir + passName + ".pass"); err != nil {
-		return Pass{}, err
-	}
+// passLocks serialises the generation of passes per company within this server.
+// LockCompany serialises it between the replicas
+var passLocks = NewKeyedMutex()
 
-	// Create pass.json
-	passJSON, err := json.MarshalIndent(passCard, "", " ")
+// GeneratePass saves the pass in the database and stores its signed pkpass file once the pass is committed.
+// If the company already had a pass, the push about its update is queued in the same transaction
+func GeneratePass(db *gorm.DB, pass Pass, setCashback bool) (Pass, PushJob, error) {
+	companyID := pass.CompanyID
+	unlock := passLocks.Lock(companyID)
+	defer unlock()
+
+	var (
+		passDB Pass
+		job    PushJob
+		pkpass []byte
+	)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := LockCompany(tx, companyID); err != nil {
+			return err
+		}
+
+		var (
+			created bool
+			err     error
+		)
+		passDB, created, err = AddNewPass(tx, pass, setCashback)
+		if err != nil {
+			return fmt.Errorf("error adding new pass: %w", err)
+		}
+
+		if err := RecordCashbackAdjustment(tx, passDB, cashbackAdjustmentReason); err != nil {
+			return fmt.Errorf("error recording cashback: %w", err)
+		}
+
+		// The pass is rendered in the transaction, so a pass that can't be rendered is not saved
+		pkpass, err = renderPKPass(passDB)
+		if err != nil {
+			return err
+		}
+
+		// The devices of an existing pass get its new data and design, a new pass has no devices yet
+		if !created {
+			job, err = EnqueuePush(tx, passDB.ID.String())
+			if err != nil {
+				return fmt.Errorf("error queueing push: %v", err)
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return Pass{}, fmt.Errorf("error marshalling pass.json: %v", err)
-	}
-	passFilePath := TempDir + passName + ".pass" + "/pass.json"
-	if err := os.WriteFile(passFilePath, passJSON, 0644); err != nil {
-		return Pass{}, fmt.Errorf("error writing pass.json: %v", err)
+		return Pass{}, PushJob{}, err
 	}
-	manifest := make(map[string]string)
-	manifest["pass.json"] = Sha1Hash(passJSON)
 
-	// Move images from template directory to pass directory
-	imageManifest, err := CopyImages(TemplateDir, TempDir+passName+".pass")
-	if err != nil {
-		return Pass{}, fmt.Errorf("error copying images: %v", err)
+	if err := storeCommittedPKPass(db, passDB, pkpass); err != nil {
+		return Pass{}, PushJob{}, err
 	}
 
-	// Create manifest.json
-	manifest = MergeMaps(manifest, imageManifest)
-	manifestJSON, err := json.MarshalIndent(manifest, "", " ")
+	return passDB, job, nil
+}
+
+// UpdatePassCashback updates the cashback of the company's pass, regenerates its pkpass file
+// and queues the push about the update in the same transaction
+func UpdatePassCashback(db *gorm.DB, companyID string, cashback Money, version int64) (Pass, PushJob, error) {
+	return updatePass(db, companyID, func(tx *gorm.DB) (Pass, bool, error) {
+		pass, err := UpdatePassByCompanyID(tx, companyID, cashback, version)
+		if err != nil {
+			return Pass{}, false, err
+		}
+		return pass, true, RecordCashbackAdjustment(tx, pass, cashbackAdjustmentReason)
+	})
+}
+
+// UpdatePassPlan changes the plan of the company's pass, so it gets the design of the new plan.
+// The pass is regenerated and the push about the update is queued in the same transaction
+func UpdatePassPlan(db *gorm.DB, companyID, plan string, version int64) (Pass, PushJob, error) {
+	return updatePass(db, companyID, func(tx *gorm.DB) (Pass, bool, error) {
+		pass, err := UpdatePassPlanByCompanyID(tx, companyID, plan, version)
+		return pass, true, err
+	})
+}
+
+// updatePass applies the update to the company's pass under the company lock. If the update changed the pass,
+// its pkpass file is rendered and the push about the update is queued in the same transaction.
+// The file is stored once the transaction is committed, so it never shows an update that was rolled back
+func updatePass(db *gorm.DB, companyID string, update func(tx *gorm.DB) (Pass, bool, error)) (Pass, PushJob, error) {
+	return changePass(db, companyID, true, update)
+}
+
+// changePass is updatePass with the push optional, for the changes the installed passes can't get
+func changePass(db *gorm.DB, companyID string, push bool, update func(tx *gorm.DB) (Pass, bool, error)) (Pass, PushJob, error) {
+	unlock := passLocks.Lock(companyID)
+	defer unlock()
+
+	var (
+		passDB Pass
+		job    PushJob
+		pkpass []byte
+	)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := LockCompany(tx, companyID); err != nil {
+			return err
+		}
+
+		var (
+			changed bool
+			err     error
+		)
+		passDB, changed, err = update(tx)
+		if err != nil {
+			return fmt.Errorf("error updating pass: %w", err)
+		}
+		if !changed {
+			return nil
+		}
+
+		pkpass, err = renderPKPass(passDB)
+		if err != nil {
+			return err
+		}
+
+		if !push {
+			return nil
+		}
+		job, err = EnqueuePush(tx, passDB.ID.String())
+		if err != nil {
+			return fmt.Errorf("error queueing push: %v", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return Pass{}, fmt.Errorf("error marshalling manifest.json: %v", err)
+		return Pass{}, PushJob{}, err
 	}
-	if err := os.WriteFile(TempDir+passName+".pass/manifest.json", manifestJSON, 0644); err != nil {
-		return Pass{}, fmt.Errorf("error writing manifest.json: %v", err)
+
+	if pkpass != nil {
+		if err := storeCommittedPKPass(db, passDB, pkpass); err != nil {
+			return Pass{}, PushJob{}, err
+		}
 	}
 
-	//Sign the pass
-	err = signingPassFile(passName)
+	return passDB, job, nil
+}
+
+// DeletePass deletes the company's pass. Wallet gets a 404 for the deleted pass, and its registrations,
+// pending push jobs and pkpass file are removed once the deletion is committed
+func DeletePass(db *gorm.DB, companyID string) (Pass, error) {
+	unlock := passLocks.Lock(companyID)
+	defer unlock()
+
+	var pass Pass
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := LockCompany(tx, companyID); err != nil {
+			return err
+		}
+		if err := tx.Where("company_id = ?", companyID).First(&pass).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&pass).Error
+	})
 	if err != nil {
-		return Pass{}, fmt.Errorf("error signing pass: %v", err)
+		return Pass{}, err
 	}
 
-	// Create pkpass
-	err = createPKPassFile(passName)
-	if err != nil {
-		return Pass{}, fmt.Errorf("error creating pkpass: %v", err)
+	if err := purgePasses(db, []Pass{pass}); err != nil {
+		return Pass{}, fmt.Errorf("error removing the data of the deleted pass: %w", err)
 	}
 
-	// Remove tmp directory of the pass
-	err = os.RemoveAll(TempDir + passName + ".pass")
+	log.Info().
+		Str("CompanyID", companyID).
+		Str("SerialNumber", pass.ID.String()).
+		Msg("Pass deleted")
+
+	return pass, nil
+}
+
+// publishPass renders the pkpass file of the committed state of the pass and stores it
+func publishPass(db *gorm.DB, pass Pass) error {
+	pkpass, err := renderPKPass(pass)
 	if err != nil {
-		log.Error().
-			Err(err).
-			Msg("Error removing tmp directory")
+		return err
 	}
 
-	return passDB, nil
+	return storeCommittedPKPass(db, pass, pkpass)
+}
+
+// storeCommittedPKPass stores the pkpass file rendered from the committed pass. The files of other versions of the pass
+// can be stored concurrently by other requests or replicas, so after storing it the version of the pass is checked again,
+// and the file of the latest version is stored if it changed
+func storeCommittedPKPass(db *gorm.DB, pass Pass, pkpass []byte) error {
+	for {
+		if err := storePKPass(pass, pkpass); err != nil {
+			return err
+		}
+		if passDelivery != PassDeliveryFile {
+			return nil
+		}
+
+		latest, err := GetPassBySerialNumber(db, pass.ID.String())
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if latest.Version == pass.Version {
+			return nil
+		}
+
+		pass = latest
+		if pkpass, err = renderPKPass(pass); err != nil {
+			return err
+		}
+	}
 }
 
-// signingPassFile signs the pass with the certificates
-func signingPassFile(passName string) error {
-	CERT_PASSWORD := os.Getenv("CERT_PASSWORD")
-	cmd := exec.Command("openssl", "smime", "-binary", "-sign", "-certfile", CertificatesDir+"WWDR.pem", "-signer", CertificatesDir+"passcertificate.pem", "-inkey", CertificatesDir+"passkey.pem", "-in", TempDir+passName+".pass/manifest.json", "-out", TempDir+passName+".pass/signature", "-outform", "DER", "-passin", "pass:"+CERT_PASSWORD)
+// storePKPass stores the rendered pkpass file of the pass. In the file delivery mode it atomically replaces the one in the blob storage,
+// in the render delivery mode it is cached for the next requests. Call it only with passes that are committed
+func storePKPass(pass Pass, pkpass []byte) error {
+	if passDelivery == PassDeliveryRender {
+		passCache.Add(pass.ID.String(), passVersion(pass), pkpass)
+		return nil
+	}
+
+	if err := passStore.Put(context.Background(), passBlobKey(pass), pkpass); err != nil {
+		return fmt.Errorf("error storing pkpass: %v", err)
+	}
 
 	log.Debug().
-		Str("Command", cmd.Path).
-		Strs("Args", cmd.Args).
-		Msg("Signing pass with OpenSSL command")
+		Str("passName", pass.ID.String()).
+		Msg("PKPass file created successfully")
+
+	return nil
+}
 
-	err := cmd.Run()
+// LoadPKPass returns the pkpass file of the pass. In the render delivery mode it is rendered from the pass
+// unless the current version is cached, in the file delivery mode it is read from the blob storage
+func LoadPKPass(ctx context.Context, pass Pass) ([]byte, error) {
+	serialNumber := pass.ID.String()
+
+	if passDelivery != PassDeliveryRender {
+		return passStore.Get(ctx, passBlobKey(pass))
+	}
+
+	version := passVersion(pass)
+	if pkpass, ok := passCache.Get(serialNumber, version); ok {
+		return pkpass, nil
+	}
+
+	pkpass, err := renderPKPass(pass)
 	if err != nil {
-		log.Error().
-			Err(err).
-			Msg("Error executing OpenSSL command")
-		return err
+		return nil, err
 	}
+	passCache.Add(serialNumber, version, pkpass)
+
 	log.Debug().
-		Str("passName", passName).
-		Msg("Signing of the pass executed successfully")
-	return nil
+		Str("SerialNumber", serialNumber).
+		Str("Version", version).
+		Msg("PKPass file rendered on demand")
+
+	return pkpass, nil
+}
+
+// passBlobKey returns the key of the pkpass file of the pass in the blob storage
+func passBlobKey(pass Pass) string {
+	return pass.ID.String() + ".pkpass"
+}
 
+// passVersion identifies the state of the pass and of its template the pkpass file was rendered from
+func passVersion(pass Pass) string {
+	version := strconv.FormatInt(pass.Version, 10)
+	if template, err := GetPassTemplateFor(pass); err == nil {
+		version += "." + template.Version
+	}
+	return version
 }
 
-// createPKPassFile creates the pkpass file. It returns the name of the pkpass file
-func createPKPassFile(passName string) error {
-	// Change working directory
-	err := os.Chdir("./b2wData/tmp/" + passName + ".pass")
+// passLastModified returns the Last-Modified time of the delivered pkpass file of the pass. Rendered passes change
+// with their template too, the stored files only when the pass is updated
+func passLastModified(pass Pass) time.Time {
+	lastModified := pass.UpdatedAt
+	if passDelivery != PassDeliveryRender {
+		return lastModified
+	}
+	if template, err := GetPassTemplateFor(pass); err == nil && template.ModifiedAt.After(lastModified) {
+		lastModified = template.ModifiedAt
+	}
+	return lastModified
+}
+
+// renderPKPass renders and signs the pkpass file of the pass in the design of its template
+func renderPKPass(pass Pass) ([]byte, error) {
+	template, err := GetPassTemplateFor(pass)
 	if err != nil {
-		log.Error().
-			Err(err).
-			Msg("Error changing working directory")
-		return err
+		return nil, err
+	}
+	passCard, err := CreatePassStructure(pass)
+	if err != nil {
+		return nil, err
+	}
+	pkpass, err := createPKPassFile(passCard, template.Files())
+	if err != nil {
+		return nil, fmt.Errorf("error creating pkpass: %v", err)
 	}
+	return pkpass, nil
+}
 
-	cmd := exec.Command("zip", "-r", "../../passes/"+passName+".pkpass", ".")
-	err = cmd.Run()
+// createPKPassFile assembles the pass.json, the template images and localizations, the manifest and its signature into a pkpass archive in memory.
+// The files map is extended with the generated files
+func createPKPassFile(passCard PassData, files map[string][]byte) ([]byte, error) {
+	passJSON, err := json.MarshalIndent(passCard, "", " ")
 	if err != nil {
-		log.Error().
-			Err(err).
-			Msg("Error executing ZIP command")
-		return err
+		return nil, fmt.Errorf("error marshalling pass.json: %v", err)
 	}
-	os.Chdir("../../../")
-	log.Debug().
-		Str("passName", passName).
-		Msg("PKPass file created successfully")
-	return nil
+
+	files["pass.json"] = passJSON
+
+	// Create manifest.json
+	manifest := make(map[string]string, len(files))
+	for name, content := range files {
+		manifest[name] = Sha1Hash(content)
+	}
+	manifestJSON, err := json.MarshalIndent(manifest, "", " ")
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling manifest.json: %v", err)
+	}
+	files["manifest.json"] = manifestJSON
+
+	// Sign the pass
+	signature, err := passSigner.Sign(manifestJSON)
+	if err != nil {
+		return nil, fmt.Errorf("error signing pass: %v", err)
+	}
+	files["signature"] = signature
+
+	return ZipFiles(files)
 }
@@ -0,0 +1,642 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	PassStyleGeneric      = "generic"      // Generic pass, used for the bank details
+	PassStyleStoreCard    = "storeCard"    // Store card, used for loyalty and cashback cards
+	PassStyleCoupon       = "coupon"       // Coupon, used for promotional offers
+	PassStyleEventTicket  = "eventTicket"  // Event ticket
+	PassStyleBoardingPass = "boardingPass" // Boarding pass, requires a transit type
+
+	TransitTypeAir     = "PKTransitTypeAir"
+	TransitTypeBoat    = "PKTransitTypeBoat"
+	TransitTypeBus     = "PKTransitTypeBus"
+	TransitTypeGeneric = "PKTransitTypeGeneric"
+	TransitTypeTrain   = "PKTransitTypeTrain"
+
+	NumberStyleDecimal    = "PKNumberStyleDecimal"
+	NumberStylePercent    = "PKNumberStylePercent"
+	NumberStyleScientific = "PKNumberStyleScientific"
+	NumberStyleSpellOut   = "PKNumberStyleSpellOut"
+
+	TextAlignmentLeft    = "PKTextAlignmentLeft"
+	TextAlignmentCenter  = "PKTextAlignmentCenter"
+	TextAlignmentRight   = "PKTextAlignmentRight"
+	TextAlignmentNatural = "PKTextAlignmentNatural"
+
+	DateStyleNone   = "PKDateStyleNone"
+	DateStyleShort  = "PKDateStyleShort"
+	DateStyleMedium = "PKDateStyleMedium"
+	DateStyleLong   = "PKDateStyleLong"
+	DateStyleFull   = "PKDateStyleFull"
+
+	DefaultPassTemplate = "generic"     // DefaultPassTemplate is used for the passes that don't select a template
+	PassTemplatesDir    = "./templates" // Directory with the pass template definitions and their images
+
+	passTemplatesReloadInterval = 2 * time.Second // passTemplatesReloadInterval is how often the templates directory is checked for changes
+)
+
+// passTemplates holds the pass templates loaded from PASS_TEMPLATES_DIR
+var passTemplates *PassTemplateStore
+
+// placeholderPattern matches the {{name}} placeholders in the template texts
+var placeholderPattern = regexp.MustCompile(`\{\{\s*(\w+)\s*\}\}`)
+
+// PassTemplate describes the design of a pass: its style, colours, images and the layout of its fields.
+// The texts of the template can contain {{name}} placeholders bound to the attributes of the pass
+type PassTemplate struct {
+	Name             string        `json:"name"`             // Name is the name passes select the template by, the file name without extension
+	Version          string        `json:"version"`          // Version changes whenever the definition or the images of the template change
+	ModifiedAt       time.Time     `json:"modifiedAt"`       // ModifiedAt is the time the current version of the template was made
+	Style            string        `json:"style"`            // Style is one of the PassStyle constants
+	TransitType      string        `json:"transitType"`      // TransitType is one of the TransitType constants, only for boarding passes
+	OrganizationName string        `json:"organizationName"` // OrganizationName is the name of the organisation issuing the pass
+	TeamIdentifier   string        `json:"teamIdentifier"`   // TeamIdentifier is the Apple team of the pass type certificate
+	Description      string        `json:"description"`      // Description is the description of the pass used by accessibility technologies
+	LogoText         string        `json:"logoText"`         // LogoText is the text displayed next to the logo
+	BackgroundColor  string        `json:"backgroundColor"`  // BackgroundColor is the background colour of the pass
+	ForegroundColor  string        `json:"foregroundColor"`  // ForegroundColor is the colour of the field values
+	LabelColor       string        `json:"labelColor"`       // LabelColor is the colour of the field labels
+	ImagesDir        string        `json:"imagesDir"`        // ImagesDir is the directory with the images of the pass, relative to the templates directory
+	Plans            []string      `json:"plans"`            // Plans are the customer plans whose passes use this template unless they select another one
+	Fields           PassStructure `json:"fields"`           // Fields is the layout of the fields of the pass
+
+	files map[string][]byte // files are the images and the localizations of the pass, keyed by their path in the pkpass archive
+}
+
+// passPlaceholders returns the values of the placeholders templates can use
+func passPlaceholders(pass Pass) map[string]string {
+	lastCashback := pass.LastCashback
+	if lastCashback.Currency == "" {
+		lastCashback.Currency = pass.Cashback.Currency
+	}
+
+	return map[string]string{
+		"serialNumber":         pass.ID.String(),
+		"companyID":            pass.CompanyID,
+		"companyName":          pass.CompanyName,
+		"iban":                 pass.IBAN,
+		"bic":                  pass.BIC,
+		"address":              pass.Address,
+		"cashback":             pass.Cashback.Decimal(),
+		"cashbackCurrency":     pass.Cashback.Currency,
+		"lastCashback":         lastCashback.Decimal(),
+		"lastCashbackCurrency": lastCashback.Currency,
+		"lastCashbackReason":   pass.LastCashbackReason,
+		"lastCashbackDate":     lastCashbackDate(pass),
+		"plan":                 pass.Plan,
+	}
+}
+
+// fillPlaceholders replaces the placeholders in the text with their values
+func fillPlaceholders(text string, values map[string]string) string {
+	return placeholderPattern.ReplaceAllStringFunc(text, func(placeholder string) string {
+		return values[placeholderPattern.FindStringSubmatch(placeholder)[1]]
+	})
+}
+
+// Layout places the data of the pass in the fields of the template.
+// The values of the fields with a currency code or a number style are rendered as numbers, so Wallet formats them for the locale of the device.
+// The fields with a date or time style must have an ISO 8601 date value, they are left out while it is empty
+func (t *PassTemplate) Layout(pass Pass) (PassStructure, error) {
+	values := passPlaceholders(pass)
+	fill := func(fields []Field) ([]Field, error) {
+		filled := make([]Field, 0, len(fields))
+		for _, field := range fields {
+			field.Label = fillPlaceholders(field.Label, values)
+			field.AttributedValue = fillPlaceholders(field.AttributedValue, values)
+			field.ChangeMessage = fillPlaceholders(field.ChangeMessage, values)
+			field.CurrencyCode = fillPlaceholders(field.CurrencyCode, values)
+
+			if value, ok := field.Value.(string); ok {
+				value = fillPlaceholders(value, values)
+				field.Value = value
+
+				switch {
+				case field.CurrencyCode != "" || field.NumberStyle != "":
+					if _, err := strconv.ParseFloat(value, 64); err != nil {
+						return nil, fmt.Errorf("value %q of numeric field %s is not a number", value, field.Key)
+					}
+					field.Value = json.Number(value)
+				case field.DateStyle != "" || field.TimeStyle != "":
+					if value == "" {
+						continue
+					}
+					if _, err := time.Parse(time.RFC3339, value); err != nil {
+						return nil, fmt.Errorf("value %q of date field %s is not an ISO 8601 date", value, field.Key)
+					}
+				}
+			}
+
+			filled = append(filled, field)
+		}
+		return filled, nil
+	}
+
+	structure := PassStructure{TransitType: t.TransitType}
+	sections := []struct {
+		fields []Field
+		filled *[]Field
+	}{
+		{t.Fields.HeaderFields, &structure.HeaderFields},
+		{t.Fields.PrimaryFields, &structure.PrimaryFields},
+		{t.Fields.SecondaryFields, &structure.SecondaryFields},
+		{t.Fields.BackFields, &structure.BackFields},
+		{t.Fields.AuxiliaryFields, &structure.AuxiliaryFields},
+	}
+	for _, section := range sections {
+		filled, err := fill(section.fields)
+		if err != nil {
+			return PassStructure{}, err
+		}
+		*section.filled = filled
+	}
+
+	return structure, nil
+}
+
+// Files returns a copy of the images and the localizations of the template, keyed by their path in the pkpass archive
+func (t *PassTemplate) Files() map[string][]byte {
+	files := make(map[string][]byte, len(t.files))
+	for name, content := range t.files {
+		files[name] = content
+	}
+	return files
+}
+
+// texts returns all the texts of the template that can contain placeholders
+func (t *PassTemplate) texts() []string {
+	texts := []string{t.Description, t.LogoText}
+	for _, fields := range [][]Field{t.Fields.HeaderFields, t.Fields.PrimaryFields, t.Fields.SecondaryFields, t.Fields.AuxiliaryFields, t.Fields.BackFields} {
+		for _, field := range fields {
+			texts = append(texts, field.Label, field.AttributedValue, field.ChangeMessage, field.CurrencyCode)
+			if value, ok := field.Value.(string); ok {
+				texts = append(texts, value)
+			}
+		}
+	}
+	return texts
+}
+
+// validate checks the template can be rendered into a valid pass
+func (t *PassTemplate) validate() error {
+	var structure PassStructure
+	structure.TransitType = t.TransitType
+	if err := (&PassData{}).SetStructure(t.Style, structure); err != nil {
+		return err
+	}
+
+	if t.OrganizationName == "" || t.TeamIdentifier == "" || t.Description == "" {
+		return errors.New("organizationName, teamIdentifier and description are required")
+	}
+
+	known := passPlaceholders(Pass{})
+	for _, text := range t.texts() {
+		for _, match := range placeholderPattern.FindAllStringSubmatch(text, -1) {
+			if _, ok := known[match[1]]; !ok {
+				return fmt.Errorf("unknown placeholder %s", match[0])
+			}
+		}
+	}
+
+	for _, fields := range [][]Field{t.Fields.HeaderFields, t.Fields.PrimaryFields, t.Fields.SecondaryFields, t.Fields.AuxiliaryFields} {
+		for _, field := range fields {
+			if field.AttributedValue != "" {
+				return fmt.Errorf("field %s: attributedValue is only allowed on back fields", field.Key)
+			}
+		}
+	}
+
+	keys := make(map[string]bool)
+	for _, fields := range [][]Field{t.Fields.HeaderFields, t.Fields.PrimaryFields, t.Fields.SecondaryFields, t.Fields.AuxiliaryFields, t.Fields.BackFields} {
+		for _, field := range fields {
+			if field.Key == "" {
+				return errors.New("every field requires a key")
+			}
+			if keys[field.Key] {
+				return fmt.Errorf("duplicate field key %q", field.Key)
+			}
+			keys[field.Key] = true
+
+			if err := validateFieldFormat(field); err != nil {
+				return fmt.Errorf("field %s: %v", field.Key, err)
+			}
+		}
+	}
+
+	if _, ok := t.files["icon.png"]; !ok {
+		return fmt.Errorf("images directory %s has no icon.png", t.ImagesDir)
+	}
+	return nil
+}
+
+// validateFieldFormat checks the currency code and the number style of the field
+func validateFieldFormat(field Field) error {
+	if field.CurrencyCode != "" && field.NumberStyle != "" {
+		return errors.New("currencyCode and numberStyle can't be used together")
+	}
+	if _, ok := currencyExponents[field.CurrencyCode]; field.CurrencyCode != "" && !ok && !placeholderPattern.MatchString(field.CurrencyCode) {
+		return fmt.Errorf("unsupported currency code %q", field.CurrencyCode)
+	}
+	switch field.NumberStyle {
+	case "", NumberStyleDecimal, NumberStylePercent, NumberStyleScientific, NumberStyleSpellOut:
+	default:
+		return fmt.Errorf("unknown number style %q", field.NumberStyle)
+	}
+	if (field.DateStyle != "" || field.TimeStyle != "") && (field.CurrencyCode != "" || field.NumberStyle != "") {
+		return errors.New("date and number formats can't be used together")
+	}
+	for _, style := range []string{field.DateStyle, field.TimeStyle} {
+		switch style {
+		case "", DateStyleNone, DateStyleShort, DateStyleMedium, DateStyleLong, DateStyleFull:
+		default:
+			return fmt.Errorf("unknown date style %q", style)
+		}
+	}
+	switch field.TextAlignment {
+	case "", TextAlignmentLeft, TextAlignmentCenter, TextAlignmentRight, TextAlignmentNatural:
+	default:
+		return fmt.Errorf("unknown text alignment %q", field.TextAlignment)
+	}
+	// A change message is either a text with %@ or the key of translations checked to have it when the localizations are loaded
+	if isLocalizableKey(field.ChangeMessage) {
+		if !strings.HasPrefix(field.ChangeMessage, changeMessageKeyPrefix) {
+			return fmt.Errorf("changeMessage key %q must start with %s", field.ChangeMessage, changeMessageKeyPrefix)
+		}
+	} else if field.ChangeMessage != "" && !strings.Contains(field.ChangeMessage, "%@") {
+		return fmt.Errorf("changeMessage %q must contain %%@, the placeholder of the new value", field.ChangeMessage)
+	}
+	return nil
+}
+
+// PassTemplateStore loads the pass templates from the JSON and YAML files of a directory.
+// The directory is checked for changes when templates are requested, so templates can be changed without a restart
+type PassTemplateStore struct {
+	dir string
+
+	mu        sync.Mutex
+	templates map[string]*PassTemplate
+	plans     map[string]string // plans maps the customer plans to the names of their templates
+	snapshot  string            // snapshot identifies the state of the files the templates were loaded from
+	checkedAt time.Time         // checkedAt is the last time the directory was checked for changes
+}
+
+// NewPassTemplateStore loads the templates in the directory. The default template is required
+func NewPassTemplateStore(dir string) (*PassTemplateStore, error) {
+	s := &PassTemplateStore{dir: dir}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload loads the templates again if any file in the directory changed.
+// If the new templates are invalid the previous ones are kept and the error is returned
+func (s *PassTemplateStore) Reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.reload()
+}
+
+func (s *PassTemplateStore) reload() error {
+	s.checkedAt = time.Now()
+
+	snapshot, err := s.dirSnapshot()
+	if err != nil {
+		return err
+	}
+	if snapshot == s.snapshot {
+		return nil
+	}
+
+	templates, plans, err := loadPassTemplates(s.dir)
+	if err != nil {
+		return err
+	}
+	// ModifiedAt is the Last-Modified time of the rendered passes, so it has to grow whenever the version changes,
+	// even if the files of the new version are older, like after a rollback
+	for name, template := range templates {
+		if previous, ok := s.templates[name]; ok && previous.Version != template.Version && !template.ModifiedAt.After(previous.ModifiedAt) {
+			template.ModifiedAt = time.Now()
+		}
+	}
+
+	s.templates = templates
+	s.plans = plans
+	s.snapshot = snapshot
+	log.Info().Str("Dir", s.dir).Strs("Templates", s.names()).Msg("Loaded pass templates")
+	return nil
+}
+
+// dirSnapshot lists the name, size and modification time of every file in the directory
+func (s *PassTemplateStore) dirSnapshot() (string, error) {
+	var snapshot strings.Builder
+	err := filepath.WalkDir(s.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&snapshot, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	return snapshot.String(), err
+}
+
+// Get returns the template with the given name, or the default one if the name is empty
+func (s *PassTemplateStore) Get(name string) (*PassTemplate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.get(name)
+}
+
+// ForPass returns the template selected by the pass. Passes that don't select one use the template of their plan,
+// or the default template if their plan has none. So do the passes whose template was removed, so they can still be updated
+func (s *PassTemplateStore) ForPass(pass Pass) (*PassTemplate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reloadIfStale()
+
+	if pass.Template != "" {
+		if template, ok := s.templates[pass.Template]; ok {
+			return template, nil
+		}
+		log.Warn().
+			Str("SerialNumber", pass.ID.String()).
+			Str("Template", pass.Template).
+			Msg("The template of the pass was removed, using the template of its plan")
+	}
+	return s.get(s.plans[NormalizePlan(pass.Plan)])
+}
+
+func (s *PassTemplateStore) get(name string) (*PassTemplate, error) {
+	if name == "" {
+		name = DefaultPassTemplate
+	}
+
+	s.reloadIfStale()
+
+	template, ok := s.templates[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown pass template %q", name)
+	}
+	return template, nil
+}
+
+// reloadIfStale reloads the templates if the directory wasn't checked for changes recently
+func (s *PassTemplateStore) reloadIfStale() {
+	if time.Since(s.checkedAt) < passTemplatesReloadInterval {
+		return
+	}
+	if err := s.reload(); err != nil {
+		log.Error().Err(err).Str("Dir", s.dir).Msg("Failed to reload pass templates, keeping the previous ones")
+	}
+}
+
+// Plans returns the template of every plan
+func (s *PassTemplateStore) Plans() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	plans := make(map[string]string, len(s.plans))
+	for plan, name := range s.plans {
+		plans[plan] = name
+	}
+	return plans
+}
+
+// List returns all the templates in name order
+func (s *PassTemplateStore) List() []*PassTemplate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	templates := make([]*PassTemplate, 0, len(s.templates))
+	for _, name := range s.names() {
+		templates = append(templates, s.templates[name])
+	}
+	return templates
+}
+
+// Names returns the names of all the templates in alphabetical order
+func (s *PassTemplateStore) Names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.names()
+}
+
+func (s *PassTemplateStore) names() []string {
+	names := make([]string, 0, len(s.templates))
+	for name := range s.templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadPassTemplates reads and validates every .json, .yaml and .yml template in the directory.
+// It returns the templates by name and the names of the templates of the plans
+func loadPassTemplates(dir string) (map[string]*PassTemplate, map[string]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	localizations, err := loadLocalizations(filepath.Join(dir, LocalizationsDir))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading localizations: %v", err)
+	}
+
+	templates := make(map[string]*PassTemplate)
+	plans := make(map[string]string)
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".json" && ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+
+		name := strings.TrimSuffix(entry.Name(), ext)
+		if _, ok := templates[name]; ok {
+			return nil, nil, fmt.Errorf("pass template %s is defined more than once", name)
+		}
+
+		template, err := loadPassTemplate(dir, entry.Name(), localizations)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error in pass template %s: %v", entry.Name(), err)
+		}
+		template.Name = name
+		templates[name] = template
+
+		for _, plan := range template.Plans {
+			plan = NormalizePlan(plan)
+			if other, ok := plans[plan]; ok {
+				return nil, nil, fmt.Errorf("plan %q is mapped to both pass templates %s and %s", plan, other, name)
+			}
+			plans[plan] = name
+		}
+	}
+
+	if _, ok := templates[DefaultPassTemplate]; !ok {
+		return nil, nil, fmt.Errorf("default pass template %s not found in %s", DefaultPassTemplate, dir)
+	}
+	return templates, plans, nil
+}
+
+// loadPassTemplate reads a template definition and its images, and adds the localizations to its files.
+// YAML definitions are converted to JSON, so both formats share the same strictly checked schema
+func loadPassTemplate(dir, fileName string, localizations map[string][]byte) (*PassTemplate, error) {
+	definition, err := os.ReadFile(filepath.Join(dir, fileName))
+	if err != nil {
+		return nil, err
+	}
+
+	if ext := filepath.Ext(fileName); ext == ".yaml" || ext == ".yml" {
+		var value interface{}
+		if err := yaml.Unmarshal(definition, &value); err != nil {
+			return nil, err
+		}
+		if definition, err = json.Marshal(value); err != nil {
+			return nil, err
+		}
+	}
+
+	var template PassTemplate
+	decoder := json.NewDecoder(bytes.NewReader(definition))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&template); err != nil {
+		return nil, err
+	}
+
+	if template.ImagesDir == "" || filepath.IsAbs(template.ImagesDir) {
+		return nil, errors.New("imagesDir must be a directory relative to the templates directory")
+	}
+	if template.files, err = ReadFiles(filepath.Join(dir, template.ImagesDir)); err != nil {
+		return nil, fmt.Errorf("error reading images: %v", err)
+	}
+	for name, content := range localizations {
+		template.files[name] = content
+	}
+
+	hash := sha1.New()
+	hash.Write(definition)
+	fileNames := make([]string, 0, len(template.files))
+	for name := range template.files {
+		fileNames = append(fileNames, name)
+	}
+	sort.Strings(fileNames)
+	for _, name := range fileNames {
+		hash.Write([]byte(name))
+		hash.Write(template.files[name])
+	}
+	template.Version = hex.EncodeToString(hash.Sum(nil))[:12]
+
+	if template.ModifiedAt, err = latestModTime(
+		filepath.Join(dir, fileName),
+		filepath.Join(dir, template.ImagesDir),
+		filepath.Join(dir, LocalizationsDir),
+	); err != nil {
+		return nil, err
+	}
+
+	if err := template.validate(); err != nil {
+		return nil, err
+	}
+	return &template, nil
+}
+
+// latestModTime returns the latest modification time of the files, and of the files in the directories
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		infos := []fs.FileInfo{info}
+		if info.IsDir() {
+			entries, err := os.ReadDir(path)
+			if err != nil {
+				return time.Time{}, err
+			}
+			for _, entry := range entries {
+				if info, err := entry.Info(); err == nil && !entry.IsDir() {
+					infos = append(infos, info)
+				}
+			}
+		}
+
+		for _, info := range infos {
+			if info.ModTime().After(latest) {
+				latest = info.ModTime()
+			}
+		}
+	}
+	return latest, nil
+}
+
+// GetPassTemplate returns the pass template with the given name, or the default one if the name is empty
+func GetPassTemplate(name string) (*PassTemplate, error) {
+	return passTemplates.Get(name)
+}
+
+// GetPassTemplateFor returns the pass template defining the design of the pass
+func GetPassTemplateFor(pass Pass) (*PassTemplate, error) {
+	return passTemplates.ForPass(pass)
+}
+
+// NormalizePlan returns the plan in the form it is stored and mapped to templates
+func NormalizePlan(plan string) string {
+	return strings.ToLower(strings.TrimSpace(plan))
+}
+
+// PassTemplateNames returns the names of all the pass templates in alphabetical order
+func PassTemplateNames() []string {
+	return passTemplates.Names()
+}
+
+// isTransitType reports whether the value is one of the transit types of boarding passes
+func isTransitType(transitType string) bool {
+	switch transitType {
+	case TransitTypeAir, TransitTypeBoat, TransitTypeBus, TransitTypeGeneric, TransitTypeTrain:
+		return true
+	}
+	return false
+}
+
+func listPassTemplatesRequest(c *gin.Context) {
+	c.JSON(200, gin.H{
+		"message":   "Pass templates were retrieved successfully",
+		"templates": passTemplates.List(),
+		"plans":     passTemplates.Plans(),
+	})
+}
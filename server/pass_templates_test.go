@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPassTemplateStoreForPass(t *testing.T) {
+	store := &PassTemplateStore{
+		templates: map[string]*PassTemplate{
+			DefaultPassTemplate: {Name: DefaultPassTemplate},
+			"storeCard":         {Name: "storeCard"},
+			"coupon":            {Name: "coupon"},
+		},
+		plans:     map[string]string{"standard": "storeCard"},
+		checkedAt: time.Now(),
+	}
+
+	tests := []struct {
+		name     string
+		pass     Pass
+		template string
+	}{
+		{"default", Pass{}, DefaultPassTemplate},
+		{"plan", Pass{Plan: "Standard"}, "storeCard"},
+		{"plan without template", Pass{Plan: "premium"}, DefaultPassTemplate},
+		{"selected template", Pass{Plan: "standard", Template: "coupon"}, "coupon"},
+		{"removed template", Pass{Plan: "standard", Template: "event"}, "storeCard"},
+		{"removed template without plan", Pass{Template: "event"}, DefaultPassTemplate},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			template, err := store.ForPass(test.pass)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if template.Name != test.template {
+				t.Errorf("template = %s, want %s", template.Name, test.template)
+			}
+		})
+	}
+}
+
+func TestPassTemplateLayout(t *testing.T) {
+	template := &PassTemplate{
+		TransitType: TransitTypeTrain,
+		Fields: PassStructure{
+			HeaderFields: []Field{
+				{Key: "cashback", Label: "{{ companyName }}", Value: "{{cashback}}", CurrencyCode: "{{cashbackCurrency}}", ChangeMessage: "Cashback: %@"},
+			},
+			PrimaryFields: []Field{
+				{Key: "iban", Label: "IBAN", Value: "{{iban}} ({{bic}})"},
+				{Key: "plan", Label: "label.plan", Value: "{{plan}}{{unknown}}"},
+			},
+			BackFields: []Field{
+				{Key: "lastCashbackDate", Label: "Date", Value: "{{lastCashbackDate}}", DateStyle: "PKDateStyleShort"},
+				{Key: "count", Label: "Count", Value: 3},
+			},
+		},
+	}
+	lastCashbackAt := time.Date(2024, 3, 1, 12, 30, 0, 0, time.FixedZone("CET", 3600))
+	pass := Pass{
+		CompanyName:    "Finom",
+		IBAN:           "DE89370400440532013000",
+		BIC:            "COBADEFFXXX",
+		Cashback:       Money{1250, "EUR"},
+		Plan:           "standard",
+		LastCashbackAt: &lastCashbackAt,
+	}
+
+	structure, err := template.Layout(pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := PassStructure{
+		TransitType: TransitTypeTrain,
+		HeaderFields: []Field{
+			{Key: "cashback", Label: "Finom", Value: json.Number("12.50"), CurrencyCode: "EUR", ChangeMessage: "Cashback: %@"},
+		},
+		PrimaryFields: []Field{
+			{Key: "iban", Label: "IBAN", Value: "DE89370400440532013000 (COBADEFFXXX)"},
+			{Key: "plan", Label: "label.plan", Value: "standard"},
+		},
+		SecondaryFields: []Field{},
+		BackFields: []Field{
+			{Key: "lastCashbackDate", Label: "Date", Value: "2024-03-01T11:30:00Z", DateStyle: "PKDateStyleShort"},
+			{Key: "count", Label: "Count", Value: 3},
+		},
+		AuxiliaryFields: []Field{},
+	}
+	if !reflect.DeepEqual(structure, want) {
+		t.Errorf("Layout = %+v, want %+v", structure, want)
+	}
+
+	// The template is not changed by the layout
+	if template.Fields.HeaderFields[0].Value != "{{cashback}}" {
+		t.Errorf("template value = %v", template.Fields.HeaderFields[0].Value)
+	}
+
+	// Date fields without a date are left out
+	pass.LastCashbackAt = nil
+	structure, err = template.Layout(pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(structure.BackFields) != 1 || structure.BackFields[0].Key != "count" {
+		t.Errorf("back fields = %+v, want only count", structure.BackFields)
+	}
+}
+
+func TestPassTemplateLayoutErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		field Field
+	}{
+		{"text in a currency field", Field{Key: "cashback", Value: "{{companyName}}", CurrencyCode: "EUR"}},
+		{"text in a number field", Field{Key: "plan", Value: "{{plan}}", NumberStyle: "PKNumberStyleDecimal"}},
+		{"text in a date field", Field{Key: "date", Value: "{{companyName}}", DateStyle: "PKDateStyleShort"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			template := &PassTemplate{Fields: PassStructure{BackFields: []Field{test.field}}}
+			if structure, err := template.Layout(Pass{CompanyName: "Finom", Plan: "standard"}); err == nil {
+				t.Errorf("Layout = %+v, want an error", structure)
+			}
+		})
+	}
+}
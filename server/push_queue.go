@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	PushJobPending = "pending" // The push is waiting for the next delivery attempt
+	PushJobSent    = "sent"    // The push was delivered to every device that could receive it
+	PushJobDead    = "dead"    // The push failed too many times and waits for a manual replay
+
+	pushPollInterval = time.Second      // How often idle workers look for due jobs
+	pushLease        = 2 * time.Minute  // How long a claimed job is hidden from the other workers
+	pushBaseBackoff  = 5 * time.Second  // Delay before the first retry, doubled on every attempt
+	pushMaxBackoff   = 30 * time.Minute // Upper bound of the retry delay
+)
+
+// pushMaxAttempts is the number of attempts before a job is moved to the dead state
+var pushMaxAttempts = 10
+
+// EnqueuePush adds a pending push about the update of the pass to the outbox.
+// Pass it the transaction that updates the pass, so the push is stored only if the update is committed
+func EnqueuePush(tx *gorm.DB, serialNumber string) (PushJob, error) {
+	job := PushJob{
+		SerialNumber:  serialNumber,
+		Status:        PushJobPending,
+		NextAttemptAt: time.Now(),
+	}
+	if err := tx.Create(&job).Error; err != nil {
+		return PushJob{}, err
+	}
+
+	return job, nil
+}
+
+// GetPushJobs returns the push jobs with the given status, or all of them if the status is empty, newest first
+func GetPushJobs(db *gorm.DB, status string, limit int) ([]PushJob, error) {
+	query := db.Order("id DESC").Limit(limit)
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var jobs []PushJob
+	if err := query.Find(&jobs).Error; err != nil {
+		return nil, err
+	}
+
+	return jobs, nil
+}
+
+// ReplayPushJob resets the push job to pending so the workers deliver it again
+func ReplayPushJob(db *gorm.DB, id uint) (PushJob, error) {
+	var job PushJob
+	if err := db.First(&job, id).Error; err != nil {
+		return PushJob{}, err
+	}
+
+	if err := db.Model(&job).Updates(map[string]interface{}{
+		"status":          PushJobPending,
+		"attempts":        0,
+		"next_attempt_at": time.Now(),
+		"last_error":      "",
+	}).Error; err != nil {
+		return PushJob{}, err
+	}
+
+	return job, nil
+}
+
+// StartPushWorkers starts the workers draining the push outbox until the context is cancelled
+func StartPushWorkers(ctx context.Context, db *gorm.DB, workers int) {
+	for i := 0; i < workers; i++ {
+		go runPushWorker(ctx, db, i)
+	}
+
+	log.Info().
+		Int("Workers", workers).
+		Int("MaxAttempts", pushMaxAttempts).
+		Msg("Push workers started")
+}
+
+func runPushWorker(ctx context.Context, db *gorm.DB, worker int) {
+	for {
+		job, err := claimPushJob(db)
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Error().Err(err).Int("Worker", worker).Msg("Error claiming push job")
+		}
+
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(pushPollInterval):
+			}
+			continue
+		}
+
+		processPushJob(db, job)
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// claimPushJob takes the oldest due pending job and hides it from the other workers for the lease time
+func claimPushJob(db *gorm.DB) (PushJob, error) {
+	var job PushJob
+	err := db.Transaction(func(tx *gorm.DB) error {
+		rec := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_attempt_at <= ?", PushJobPending, time.Now()).
+			Order("next_attempt_at").
+			Limit(1).
+			Find(&job)
+		if rec.Error != nil {
+			return rec.Error
+		}
+		if rec.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		job.Attempts++
+		job.NextAttemptAt = time.Now().Add(pushLease)
+		return tx.Model(&job).Updates(map[string]interface{}{
+			"attempts":        job.Attempts,
+			"next_attempt_at": job.NextAttemptAt,
+		}).Error
+	})
+
+	return job, err
+}
+
+// processPushJob sends the push and stores the outcome, scheduling a retry with exponential backoff on failure
+func processPushJob(db *gorm.DB, job PushJob) {
+	// The file is stored after the update is committed. Storing it again before the push makes sure
+	// the devices download the committed pass, even if the request storing it failed or didn't finish yet
+	err := republishPass(db, job.SerialNumber)
+	var results []PushResult
+	if err == nil {
+		results, err = SendNotificationPushAboutUpdate(job.SerialNumber)
+	}
+	if err == nil {
+		err = retryablePushError(results)
+	}
+
+	updates := map[string]interface{}{
+		"devices_notified": CountSentPushes(results),
+	}
+	switch {
+	case err == nil:
+		updates["status"] = PushJobSent
+		updates["last_error"] = ""
+	case job.Attempts >= pushMaxAttempts:
+		updates["status"] = PushJobDead
+		updates["last_error"] = err.Error()
+	default:
+		updates["status"] = PushJobPending
+		updates["next_attempt_at"] = time.Now().Add(pushBackoff(job.Attempts))
+		updates["last_error"] = err.Error()
+	}
+
+	if dbErr := db.Model(&job).Updates(updates).Error; dbErr != nil {
+		log.Error().Err(dbErr).Uint("JobID", job.ID).Msg("Error saving push job result")
+		return
+	}
+
+	log.Info().
+		Uint("JobID", job.ID).
+		Str("SerialNumber", job.SerialNumber).
+		Int("Attempt", job.Attempts).
+		Interface("Status", updates["status"]).
+		AnErr("Error", err).
+		Msg("Push job processed")
+}
+
+// republishPass stores the pkpass file of the committed state of the pass in the file delivery mode.
+// Deleted passes are skipped, the devices get a 404 for them
+func republishPass(db *gorm.DB, serialNumber string) error {
+	if passDelivery != PassDeliveryFile {
+		return nil
+	}
+
+	pass, err := GetPassBySerialNumber(db, serialNumber)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return publishPass(db, pass)
+}
+
+// retryablePushError returns an error if the push failed for any device for a reason that may go away,
+// such as a network error, APNs throttling or an APNs server error
+func retryablePushError(results []PushResult) error {
+	failures := []string{}
+	for _, result := range results {
+		switch {
+		case result.Error != "":
+			failures = append(failures, result.Error)
+		case result.StatusCode == 429 || result.StatusCode >= 500:
+			failures = append(failures, strconv.Itoa(result.StatusCode)+" "+result.Reason)
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("push failed for %d of %d devices: %s", len(failures), len(results), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// pushBackoff returns the delay before the next attempt after the given number of attempts
+func pushBackoff(attempts int) time.Duration {
+	backoff := pushBaseBackoff
+	for i := 1; i < attempts && backoff < pushMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > pushMaxBackoff {
+		backoff = pushMaxBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPushBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 5 * time.Second},
+		{1, 5 * time.Second},
+		{2, 10 * time.Second},
+		{3, 20 * time.Second},
+		{9, 1280 * time.Second},
+		{10, 30 * time.Minute}, // 42m40s capped
+		{11, 30 * time.Minute},
+		{100, 30 * time.Minute},
+	}
+	for _, test := range tests {
+		if got := pushBackoff(test.attempts); got != test.want {
+			t.Errorf("pushBackoff(%d) = %s, want %s", test.attempts, got, test.want)
+		}
+	}
+}
+
+func TestRetryablePushError(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []PushResult
+		retry   string // retry is a part of the error if the push should be retried, empty if it shouldn't
+	}{
+		{"no devices", nil, ""},
+		{"delivered", []PushResult{{StatusCode: 200}, {StatusCode: 200}}, ""},
+		{"dead token", []PushResult{{StatusCode: 410, Reason: "Unregistered"}}, ""},
+		{"bad token", []PushResult{{StatusCode: 400, Reason: "BadDeviceToken"}}, ""},
+		{"network error", []PushResult{{StatusCode: 200}, {Error: "connection reset"}}, "push failed for 1 of 2 devices: connection reset"},
+		{"throttled", []PushResult{{StatusCode: 429, Reason: "TooManyRequests"}}, "429 TooManyRequests"},
+		{"server error", []PushResult{{StatusCode: 503, Reason: "ServiceUnavailable"}, {StatusCode: 500, Reason: "InternalServerError"}}, "push failed for 2 of 2 devices"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := retryablePushError(test.results)
+			switch {
+			case test.retry == "" && err != nil:
+				t.Errorf("retryablePushError = %v, want nil", err)
+			case test.retry != "" && (err == nil || !strings.Contains(err.Error(), test.retry)):
+				t.Errorf("retryablePushError = %v, want an error with %q", err, test.retry)
+			}
+		})
+	}
+}
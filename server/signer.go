@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	"github.com/youmark/pkcs8"
+	"go.mozilla.org/pkcs7"
+)
+
+// PassSigner holds the pass certificate, its private key and the Apple WWDR intermediate certificate
+// and produces detached PKCS#7 signatures of manifest.json files.
+type PassSigner struct {
+	certificate  *x509.Certificate
+	privateKey   crypto.PrivateKey
+	intermediate *x509.Certificate
+}
+
+// LoadPassSigner reads the certificates and the private key from the given directory.
+// The private key is decrypted with the given password if it is encrypted.
+func LoadPassSigner(certificatesDir, password string) (*PassSigner, error) {
+	certificate, err := readCertificate(certificatesDir + "passcertificate.pem")
+	if err != nil {
+		return nil, fmt.Errorf("error loading pass certificate: %v", err)
+	}
+
+	intermediate, err := readCertificate(certificatesDir + "WWDR.pem")
+	if err != nil {
+		return nil, fmt.Errorf("error loading WWDR certificate: %v", err)
+	}
+
+	privateKey, err := readPrivateKey(certificatesDir+"passkey.pem", password)
+	if err != nil {
+		return nil, fmt.Errorf("error loading pass private key: %v", err)
+	}
+
+	return &PassSigner{
+		certificate:  certificate,
+		privateKey:   privateKey,
+		intermediate: intermediate,
+	}, nil
+}
+
+// Sign returns the detached DER encoded PKCS#7 signature of the given manifest.
+// The signature contains the signer and WWDR certificates and the signing time attribute.
+func (s *PassSigner) Sign(manifest []byte) ([]byte, error) {
+	signedData, err := pkcs7.NewSignedData(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error creating signed data: %v", err)
+	}
+	signedData.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+
+	if err := signedData.AddSignerChain(s.certificate, s.privateKey, []*x509.Certificate{s.intermediate}, pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, fmt.Errorf("error adding signer: %v", err)
+	}
+	signedData.Detach()
+
+	return signedData.Finish()
+}
+
+// readCertificate reads the first certificate from the PEM file
+func readCertificate(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+
+	// The WWDR certificate is distributed by Apple in DER format
+	return x509.ParseCertificate(data)
+}
+
+// readPrivateKey reads the private key from the PEM file, decrypting it with the password if needed
+func readPrivateKey(path, password string) (crypto.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		switch block.Type {
+		case "ENCRYPTED PRIVATE KEY":
+			return pkcs8.ParsePKCS8PrivateKey(block.Bytes, []byte(password))
+		case "PRIVATE KEY":
+			return x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			der := block.Bytes
+			// Keys exported with the legacy OpenSSL format are encrypted in the PEM headers
+			if x509.IsEncryptedPEMBlock(block) {
+				if der, err = x509.DecryptPEMBlock(block, []byte(password)); err != nil {
+					return nil, err
+				}
+			}
+			return x509.ParsePKCS1PrivateKey(der)
+		}
+	}
+
+	return nil, fmt.Errorf("no private key found in %s", path)
+}
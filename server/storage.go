@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const (
+	StorageLocal = "local" // Blobs are stored in a directory of the local filesystem
+	StorageS3    = "s3"    // Blobs are stored in a bucket of an S3-compatible object storage
+)
+
+// ErrBlobNotFound is returned when there is no blob with the requested key
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore stores the generated pkpass files
+type BlobStore interface {
+	// Put stores the data under the key, replacing the previous blob atomically
+	Put(ctx context.Context, key string, data []byte) error
+	// Get returns the data stored under the key or ErrBlobNotFound
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Delete removes the blob stored under the key. Deleting a missing blob is not an error
+	Delete(ctx context.Context, key string) error
+}
+
+// NewBlobStore creates the blob store configured by the environment variables. STORAGE_BACKEND selects
+// local (in STORAGE_DIR) or s3 (S3_ENDPOINT, S3_REGION, S3_BUCKET, S3_ACCESS_KEY, S3_SECRET_KEY, S3_USE_SSL) storage
+func NewBlobStore(ctx context.Context) (BlobStore, error) {
+	switch backend := getEnv("STORAGE_BACKEND", StorageLocal); backend {
+	case StorageLocal:
+		return NewLocalBlobStore(getEnv("STORAGE_DIR", PassesDir))
+	case StorageS3:
+		return NewS3BlobStore(ctx,
+			os.Getenv("S3_ENDPOINT"),
+			os.Getenv("S3_REGION"),
+			os.Getenv("S3_BUCKET"),
+			os.Getenv("S3_ACCESS_KEY"),
+			os.Getenv("S3_SECRET_KEY"),
+			getEnv("S3_USE_SSL", "true") == "true",
+		)
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q", backend)
+	}
+}
+
+// LocalBlobStore stores blobs as files in a directory
+type LocalBlobStore struct {
+	dir string
+}
+
+// NewLocalBlobStore returns a blob store in the directory, creating it if it doesn't exist
+func NewLocalBlobStore(dir string) (*LocalBlobStore, error) {
+	if err := CreateDir(dir); err != nil {
+		return nil, err
+	}
+	return &LocalBlobStore{dir: dir}, nil
+}
+
+func (s *LocalBlobStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.Base(key))
+}
+
+func (s *LocalBlobStore) Put(ctx context.Context, key string, data []byte) error {
+	return WriteFileAtomic(s.path(key), data, 0644)
+}
+
+func (s *LocalBlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := os.ReadFile(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return data, err
+}
+
+func (s *LocalBlobStore) Delete(ctx context.Context, key string) error {
+	err := os.Remove(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// S3BlobStore stores blobs as objects in a bucket of an S3-compatible storage such as AWS S3 or MinIO
+type S3BlobStore struct {
+	client *minio.Client
+	bucket string
+}
+
+// NewS3BlobStore connects to the storage and creates the bucket if it doesn't exist
+func NewS3BlobStore(ctx context.Context, endpoint, region, bucket, accessKey, secretKey string, useSSL bool) (*S3BlobStore, error) {
+	if endpoint == "" || bucket == "" {
+		return nil, errors.New("S3_ENDPOINT and S3_BUCKET are required for the s3 storage")
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure: useSSL,
+		Region: region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := client.BucketExists(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("error checking bucket %s: %v", bucket, err)
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{Region: region}); err != nil {
+			return nil, fmt.Errorf("error creating bucket %s: %v", bucket, err)
+		}
+	}
+
+	return &S3BlobStore{client: client, bucket: bucket}, nil
+}
+
+func (s *S3BlobStore) Put(ctx context.Context, key string, data []byte) error {
+	_, err := s.client.PutObject(ctx, s.bucket, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType: "application/vnd.apple.pkpass",
+	})
+	return err
+}
+
+func (s *S3BlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	object, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	data, err := io.ReadAll(object)
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return nil, ErrBlobNotFound
+	}
+	return data, err
+}
+
+func (s *S3BlobStore) Delete(ctx context.Context, key string) error {
+	return s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
 	"crypto/sha1"
 	"encoding/hex"
 	"io"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/rs/zerolog/log"
@@ -30,6 +34,14 @@ func SanitizeText(text string) string {
 	return sanitized
 }
 
+// getEnv returns the value of the environment variable or the fallback if it is empty
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
 // CreateDir creates a directory if it doesn't exist
 func CreateDir(dir string) error {
 	if err := os.MkdirAll(dir, 0755); err != nil {
@@ -38,6 +50,15 @@ func CreateDir(dir string) error {
 	return nil
 }
 
+// GenerateToken returns a random 32 bytes token as a hex string
+func GenerateToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
 // Sha1Hash returns the SHA1 hash of the given data as a hex string
 func Sha1Hash(data []byte) string {
 	hash := sha1.New()
@@ -45,71 +66,83 @@ func Sha1Hash(data []byte) string {
 	return hex.EncodeToString(hash.Sum(nil))
 }
 
-// MergeMaps merges two maps
-func MergeMaps(m1 map[string]string, m2 map[string]string) map[string]string {
-	merged := make(map[string]string)
-	for k, v := range m1 {
-		merged[k] = v
-	}
-	for key, value := range m2 {
-		merged[key] = value
+// WriteFileAtomic writes the data to a temporary file in the same directory and renames it to the given path,
+// so readers never see a partially written file
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
 	}
-	return merged
-}
+	// Remove the temporary file if anything fails before the rename
+	defer os.Remove(tmpFile.Name())
 
-// CopyImages copies all images from the source directory to the destination directory and returns a manifest of the images
-func CopyImages(srcDir, dstDir string) (map[string]string, error) {
-	// Ensure destination directory exists.
-	if err := CreateDir(dstDir); err != nil {
-		return nil, err
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpFile.Name(), perm); err != nil {
+		return err
 	}
 
+	return os.Rename(tmpFile.Name(), path)
+}
+
+// ReadFiles reads all files from the directory and returns their contents by file name
+func ReadFiles(dir string) (map[string][]byte, error) {
 	// Get list of files in source directory.
-	files, err := os.ReadDir(srcDir)
+	entries, err := os.ReadDir(dir)
 	if err != nil {
 		return nil, err
 	}
 
-	// Manifest for images
-	manifest := make(map[string]string)
-
-	// Iterate over each file.
-	for _, file := range files {
+	files := make(map[string][]byte, len(entries))
+	for _, entry := range entries {
 		// Skip directories.
-		if file.IsDir() {
+		if entry.IsDir() {
 			continue
 		}
 
-		// Open source file.
-		srcFile, err := os.Open(filepath.Join(srcDir, file.Name()))
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
 		if err != nil {
 			return nil, err
 		}
-		defer srcFile.Close()
+		files[entry.Name()] = content
+	}
 
-		// Create destination file.
-		newFilePath := filepath.Join(dstDir, file.Name())
-		dstFile, err := os.Create(newFilePath)
-		if err != nil {
-			return nil, err
-		}
-		defer dstFile.Close()
+	return files, nil
+}
 
-		// Copy content from source file to destination file.
-		if _, err := io.Copy(dstFile, srcFile); err != nil {
-			return nil, err
-		}
+// ZipFiles returns a zip archive with the given files. The files are added in name order
+func ZipFiles(files map[string][]byte) ([]byte, error) {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-		// Read the content of the destination file.
-		dstContent, err := os.ReadFile(newFilePath)
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, name := range names {
+		w, err := archive.Create(name)
 		if err != nil {
 			return nil, err
 		}
-
-		manifest[file.Name()] = Sha1Hash(dstContent)
+		if _, err := w.Write(files[name]); err != nil {
+			return nil, err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
 	}
 
-	return manifest, nil
+	return buf.Bytes(), nil
 }
 
 func ReadRequestBody(body io.ReadCloser) string {